@@ -0,0 +1,69 @@
+package capacitor
+
+import (
+	"math/rand"
+	"time"
+)
+
+// trackBackoff records backoff signals for a host and returns when an
+// exponential block window with jitter should end on repeated backoff
+// signals, or the zero time if the host should not be blocked further.
+// A run of BackoffResetAfter healthy responses resets the sequence.
+// The caller must hold hs.mu.
+func (t *Transport) trackBackoff(hs *hostState, outcome Outcome) time.Time {
+	switch {
+	case outcome.Action != nil && outcome.Action.Backoff:
+		// Requests sent before the last backoff belong to the same episode
+		if !outcome.Start.After(hs.lastBackoff) {
+			return time.Time{}
+		}
+		hs.backoffs++
+		hs.healthy = 0
+		hs.lastBackoff = time.Now()
+
+		if window := t.backoffWindow(hs.backoffs); window > 0 {
+			if until := hs.lastBackoff.Add(window); until.After(hs.state.GetBlockedUntil()) {
+				return until
+			}
+		}
+
+	case outcome.Congested():
+		hs.healthy = 0
+
+	default:
+		hs.healthy++
+		if hs.healthy >= t.config.BackoffResetAfter {
+			hs.backoffs = 0
+		}
+	}
+	return time.Time{}
+}
+
+// backoffWindow returns the block window for the nth consecutive backoff
+// signal. The first signal only reduces concurrency; from the second on,
+// the window starts at BackoffBaseDelay and doubles up to BackoffMaxDelay,
+// with equal jitter so that clients desynchronize.
+func (t *Transport) backoffWindow(n int) time.Duration {
+	if n < 2 {
+		return 0
+	}
+
+	window := t.config.BackoffMaxDelay
+	if shift := n - 2; shift < 32 {
+		if d := t.config.BackoffBaseDelay << shift; d > 0 && d < window {
+			window = d
+		}
+	}
+
+	return jitter(window)
+}
+
+// jitter returns a random duration in [d/2, d), so that clients waiting
+// for the same event desynchronize.
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half)) //nolint:gosec // jitter does not need crypto randomness
+}
@@ -0,0 +1,60 @@
+package capacitor
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// releaseBody wraps a response body and releases the concurrency slot
+// once the body is fully read, closed, or the request context is done.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+
+	mu   sync.Mutex
+	stop func() bool // nil until the context callback is registered
+}
+
+// newReleaseBody wraps body so that release is called exactly once.
+func newReleaseBody(ctx context.Context, body io.ReadCloser, release func()) *releaseBody {
+	b := &releaseBody{
+		ReadCloser: body,
+		release:    release,
+	}
+
+	// If ctx is already done the callback runs at once on another
+	// goroutine, so it must not see stop until it has been assigned
+	b.mu.Lock()
+	b.stop = context.AfterFunc(ctx, b.done)
+	b.mu.Unlock()
+	return b
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+// done releases the slot if it has not been released already.
+func (b *releaseBody) done() {
+	b.once.Do(func() {
+		b.mu.Lock()
+		stop := b.stop
+		b.mu.Unlock()
+		if stop != nil {
+			stop()
+		}
+		b.release()
+	})
+}
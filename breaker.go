@@ -0,0 +1,255 @@
+package capacitor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned (wrapped in a CapacityError with Op
+// "circuit_open") when a host's circuit breaker is rejecting requests.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of a host's circuit breaker.
+type BreakerState string
+
+const (
+	// BreakerClosed admits all requests.
+	BreakerClosed BreakerState = "closed"
+
+	// BreakerOpen rejects all requests until OpenTimeout passes.
+	BreakerOpen BreakerState = "open"
+
+	// BreakerHalfOpen admits a limited number of probe requests;
+	// if they succeed the breaker closes, otherwise it opens again.
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// CircuitBreaker configures a per-host circuit breaker. While closed, the
+// breaker counts failures: transport errors, 5xx responses, and responses
+// carrying backoff signals. When the failure ratio within a window reaches
+// FailureRatio, the breaker opens and requests fail immediately instead of
+// slowly. After OpenTimeout it admits HalfOpenProbes probe requests.
+type CircuitBreaker struct {
+	// FailureRatio is the fraction of failed requests that opens the breaker.
+	// Default: 0.5
+	FailureRatio float64
+
+	// MinRequests is the number of requests within a window before the
+	// failure ratio is considered.
+	// Default: 20
+	MinRequests int
+
+	// Window is the period over which failures are counted.
+	// Default: 10s
+	Window time.Duration
+
+	// OpenTimeout is how long the breaker stays open before probing.
+	// Default: 30s
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is the number of probes admitted while half-open,
+	// all of which must succeed to close the breaker.
+	// Default: 1
+	HalfOpenProbes int
+}
+
+// withDefaults returns a copy of the breaker config with defaults applied.
+func (c CircuitBreaker) withDefaults() CircuitBreaker {
+	if c.FailureRatio <= 0 || c.FailureRatio > 1 {
+		c.FailureRatio = 0.5
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 20
+	}
+	if c.Window <= 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = 30 * time.Second
+	}
+	if c.HalfOpenProbes <= 0 {
+		c.HalfOpenProbes = 1
+	}
+	return c
+}
+
+// breaker is the circuit breaker for a single host.
+type breaker struct {
+	mu     sync.Mutex
+	config CircuitBreaker
+	state  BreakerState
+
+	// Closed: failure counts for the current window
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	// Open: when the breaker opened
+	openedAt time.Time
+
+	// Half-open: probes admitted and succeeded
+	probes    int
+	successes int
+}
+
+func newBreaker(config CircuitBreaker) *breaker {
+	return &breaker{
+		config: config.withDefaults(),
+		state:  BreakerClosed,
+	}
+}
+
+// allow reports whether a request may be sent, and whether it is a probe.
+// If the breaker moved from open to half-open, changed is true.
+func (b *breaker) allow(now time.Time) (ok, probe, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.config.OpenTimeout {
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		b.successes = 0
+		changed = true
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		return false, false, changed
+	case BreakerHalfOpen:
+		if b.probes >= b.config.HalfOpenProbes {
+			return false, false, changed
+		}
+		b.probes++
+		return true, true, changed
+	}
+	return true, false, changed
+}
+
+// abandon returns an admitted probe that was never sent.
+// It is safe to call on a nil breaker.
+func (b *breaker) abandon(probe bool) {
+	if b == nil || !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// record records a request result and returns true if the state changed.
+func (b *breaker) record(now time.Time, failed, probe bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.config.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.config.MinRequests &&
+			float64(b.failures) >= b.config.FailureRatio*float64(b.requests) {
+			b.open(now)
+			return true
+		}
+
+	case BreakerHalfOpen:
+		// Results of requests admitted before the breaker opened are ignored
+		if !probe {
+			return false
+		}
+		if failed {
+			b.open(now)
+			return true
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenProbes {
+			b.state = BreakerClosed
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+			return true
+		}
+	}
+	return false
+}
+
+// open opens the breaker. The caller must hold b.mu.
+func (b *breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+}
+
+// current returns the breaker state.
+func (b *breaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// failed returns true if the outcome counts as a failure for the circuit
+// breaker: a transport error, a 5xx response, or a backoff signal.
+// Rate limiting is not a failure; it is handled by blocking.
+func (o Outcome) failed() bool {
+	if o.Err != nil {
+		return true
+	}
+	if o.StatusCode >= 500 {
+		return true
+	}
+	return o.Action != nil && o.Action.Backoff
+}
+
+// admit checks the host's circuit breaker before sending a request.
+func (t *Transport) admit(host string, hs *hostState) (probe bool, err error) {
+	if hs.breaker == nil {
+		return false, nil
+	}
+
+	ok, probe, changed := hs.breaker.allow(time.Now())
+	if changed {
+		t.breakerChanged(host, hs)
+	}
+	if !ok {
+		return false, &CapacityError{
+			Op:    "circuit_open",
+			Host:  host,
+			Err:   ErrCircuitOpen,
+			State: hs.state.Clone(),
+		}
+	}
+	return probe, nil
+}
+
+// recordBreaker feeds a request outcome to the host's circuit breaker.
+// A request cancelled by its caller says nothing about the host's health,
+// so it is not counted, and a cancelled probe is returned for another try.
+func (t *Transport) recordBreaker(host string, hs *hostState, outcome Outcome, probe bool) {
+	if hs.breaker == nil {
+		return
+	}
+	if errors.Is(outcome.Err, context.Canceled) {
+		hs.breaker.abandon(probe)
+		return
+	}
+	if hs.breaker.record(time.Now(), outcome.failed(), probe) {
+		t.breakerChanged(host, hs)
+	}
+}
+
+// breakerChanged publishes a circuit breaker transition.
+func (t *Transport) breakerChanged(host string, hs *hostState) {
+	hs.state.SetBreaker(hs.breaker.current())
+	if t.config.OnStateChange != nil {
+		t.config.OnStateChange(host, hs.state.Clone())
+	}
+}
@@ -0,0 +1,128 @@
+package capacitor
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRetryBudgetExhausted is returned (wrapped in a CapacityError with
+// Op "retry_budget") when a retry would exceed the host's retry budget.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// RetryBudget limits retries to a host to a fraction of its recent
+// successful requests, plus a small floor so that low-traffic hosts can
+// still retry. This keeps retries at several layers from multiplying the
+// load on a degraded host.
+type RetryBudget struct {
+	// Ratio is the fraction of successful requests that may be retried.
+	// Default: 0.2
+	Ratio float64
+
+	// MinRetries is the number of retries always allowed per Window.
+	// Default: 10
+	MinRetries int
+
+	// Window is how far back successes and retries are counted.
+	// Default: 10s
+	Window time.Duration
+}
+
+// withDefaults returns a copy of the budget with defaults applied.
+func (b RetryBudget) withDefaults() RetryBudget {
+	if b.Ratio <= 0 {
+		b.Ratio = 0.2
+	}
+	if b.MinRetries <= 0 {
+		b.MinRetries = 10
+	}
+	if b.Window <= 0 {
+		b.Window = 10 * time.Second
+	}
+	return b
+}
+
+// budgetBuckets is the number of buckets the budget window is split into.
+const budgetBuckets = 10
+
+// retryBudget tracks successes and retries for a host over a sliding
+// window split into buckets.
+type retryBudget struct {
+	mu      sync.Mutex
+	policy  RetryBudget
+	width   int64 // bucket width in nanoseconds
+	buckets [budgetBuckets]budgetBucket
+}
+
+type budgetBucket struct {
+	epoch     int64 // bucket index since the Unix epoch
+	successes int
+	retries   int
+}
+
+func newRetryBudget(policy RetryBudget) *retryBudget {
+	policy = policy.withDefaults()
+	width := int64(policy.Window) / budgetBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &retryBudget{policy: policy, width: width}
+}
+
+// bucket returns the current bucket, resetting it if it is from an old window.
+// The caller must hold b.mu.
+func (b *retryBudget) bucket(now time.Time) *budgetBucket {
+	epoch := now.UnixNano() / b.width
+	bucket := &b.buckets[epoch%budgetBuckets]
+	if bucket.epoch != epoch {
+		*bucket = budgetBucket{epoch: epoch}
+	}
+	return bucket
+}
+
+// totals returns the successes and retries within the window.
+// The caller must hold b.mu.
+func (b *retryBudget) totals(now time.Time) (successes, retries int) {
+	oldest := now.UnixNano()/b.width - budgetBuckets
+	for _, bucket := range b.buckets {
+		if bucket.epoch > oldest {
+			successes += bucket.successes
+			retries += bucket.retries
+		}
+	}
+	return successes, retries
+}
+
+// allowed returns the number of retries allowed for the given successes.
+func (b *retryBudget) allowed(successes int) int {
+	return b.policy.MinRetries + int(float64(successes)*b.policy.Ratio)
+}
+
+// deposit records a successful request.
+func (b *retryBudget) deposit(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(now).successes++
+}
+
+// withdraw records a retry if the budget allows it.
+func (b *retryBudget) withdraw(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	successes, retries := b.totals(now)
+	if retries >= b.allowed(successes) {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// usage returns the retries made and allowed within the window.
+func (b *retryBudget) usage(now time.Time) (retries, allowed int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	successes, retries := b.totals(now)
+	return retries, b.allowed(successes)
+}
@@ -78,6 +78,263 @@ func (b *Builder) WithTimeout(timeout time.Duration) *Builder {
 	return b
 }
 
+// WithStateExpiry sets how long host state is considered fresh.
+func (b *Builder) WithStateExpiry(expiry time.Duration) *Builder {
+	b.config.StateExpiry = expiry
+	return b
+}
+
+// WithBackoff configures how backoff signals (503, degraded status, GOAWAY)
+// are handled: concurrency is multiplied by factor, and repeated signals
+// block the host for an exponentially growing, jittered window starting
+// at base and capped at max.
+func (b *Builder) WithBackoff(factor float64, base, max time.Duration) *Builder {
+	b.config.BackoffFactor = factor
+	b.config.BackoffBaseDelay = base
+	b.config.BackoffMaxDelay = max
+	return b
+}
+
+// WithRecovery enables gradual concurrency recovery after throttling.
+// Once a host has sent no throttling signals for StateExpiry, its limit
+// is raised one step per window toward the initial concurrency.
+//
+// Example - double the limit every 30 seconds:
+//
+//	client := capacitor.Wrap(nil).
+//	    WithDefaults().
+//	    WithRecovery(capacitor.ExponentialRecovery(2)).
+//	    Build()
+func (b *Builder) WithRecovery(fn RecoveryFunc) *Builder {
+	b.config.Recovery = fn
+	return b
+}
+
+// WithController sets a factory for per-host ConcurrencyControllers,
+// which decide each host's concurrency limit from request outcomes.
+func (b *Builder) WithController(factory func() ConcurrencyController) *Builder {
+	b.config.Controller = factory
+	return b
+}
+
+// WithAIMD enables the additive-increase/multiplicative-decrease controller.
+// Each host's limit grows by increase slots per window of successful
+// requests and is multiplied by decrease on congestion. This lets the
+// client probe upward on hosts that never send capacity headers.
+//
+// Example - start at 4, probe up to 64, halve on 429/503:
+//
+//	client := capacitor.Wrap(nil).
+//	    WithDefaults().
+//	    WithConcurrency(4, 1, 64).
+//	    WithAIMD(1, 0.5).
+//	    Build()
+func (b *Builder) WithAIMD(increase int, decrease float64) *Builder {
+	return b.WithController(func() ConcurrencyController {
+		return NewAIMDController(increase, decrease)
+	})
+}
+
+// WithGradient enables the latency-gradient controller, which grows each
+// host's limit while latency stays near its no-load baseline and shrinks
+// it as queueing delay appears. Use this for hosts without capacity headers.
+func (b *Builder) WithGradient() *Builder {
+	return b.WithController(func() ConcurrencyController {
+		return NewGradientController()
+	})
+}
+
+// WithBlockMode sets how requests behave while a host is blocked.
+// BlockModeWait (the default) waits for the block to expire;
+// BlockModeFailFast returns a BlockedError immediately.
+func (b *Builder) WithBlockMode(mode BlockMode) *Builder {
+	b.config.BlockMode = mode
+	return b
+}
+
+// WithPacing spreads each host's remaining rate-limit quota (from
+// X-RateLimit-Remaining and X-RateLimit-Reset) evenly across the time until
+// the window resets, allowing up to burst requests ahead of the pace.
+// This avoids spending an hourly quota in the first seconds and then
+// sitting blocked. Use with WithRateLimitHeaders.
+func (b *Builder) WithPacing(burst int) *Builder {
+	b.config.Pacing = true
+	b.config.PacingBurst = burst
+	return b
+}
+
+// WithReleaseOnBodyClose holds each concurrency slot until the response
+// body is closed (or read to EOF, or the request context is done).
+// Use this when streaming large bodies so that in-use slots reflect
+// work the server is still doing.
+func (b *Builder) WithReleaseOnBodyClose() *Builder {
+	b.config.ReleaseOnBodyClose = true
+	return b
+}
+
+// WithCostFunc sets a function returning the number of concurrency slots each
+// request takes on its host, so expensive endpoints (bulk exports, costly
+// GraphQL queries) use more of the host's limit than cheap ones.
+//
+// Example:
+//
+//	client := capacitor.Wrap(nil).
+//	    WithCostFunc(func(req *http.Request) int {
+//	        if strings.HasPrefix(req.URL.Path, "/export") {
+//	            return 10
+//	        }
+//	        return 1
+//	    }).
+//	    Build()
+func (b *Builder) WithCostFunc(fn func(req *http.Request) int) *Builder {
+	b.config.CostFunc = fn
+	return b
+}
+
+// WithMaxTotalConcurrency caps in-flight requests across all hosts. Each
+// request takes a slot on its host and then a client-wide slot.
+func (b *Builder) WithMaxTotalConcurrency(n int) *Builder {
+	b.config.MaxTotalConcurrency = n
+	return b
+}
+
+// WithLoadShedding bounds each host's queue of requests waiting for a
+// slot. Requests beyond maxQueue waiting requests, or that have waited
+// longer than maxWait, fail with a CapacityError whose Op is "shed" rather
+// than piling up until AcquireTimeout. Zero leaves either bound unset.
+func (b *Builder) WithLoadShedding(maxQueue int, maxWait time.Duration) *Builder {
+	b.config.MaxQueueLength = maxQueue
+	b.config.MaxQueueWait = maxWait
+	return b
+}
+
+// WithDeadlineShedding rejects requests whose context deadline cannot be
+// met given the host's queue depth and average latency, instead of letting
+// them wait only to time out.
+func (b *Builder) WithDeadlineShedding() *Builder {
+	b.config.ShedByDeadline = true
+	return b
+}
+
+// WithSlowStart ramps a host's concurrency from MinConcurrency back to its
+// previous value over window once a block ends, and delays each block's
+// end by a random jitter of up to jitter, so neither this client's queued
+// requests nor other clients obeying the same signal resume all at once.
+func (b *Builder) WithSlowStart(window, jitter time.Duration) *Builder {
+	b.config.SlowStart = window
+	b.config.BlockJitter = jitter
+	return b
+}
+
+// WithPriorityAging sets how long a request waits for a slot before its
+// priority is raised by one level. Lower values protect low-priority
+// requests from starvation sooner; a negative value disables aging.
+func (b *Builder) WithPriorityAging(d time.Duration) *Builder {
+	b.config.PriorityAging = d
+	return b
+}
+
+// WithHostEviction bounds the host-state table. At most maxHosts host keys
+// are tracked (least recently used idle hosts are evicted first), and hosts
+// idle for longer than idleTTL are evicted. Zero disables either limit.
+// Hosts with requests in flight, waiting, or blocked are never evicted.
+func (b *Builder) WithHostEviction(maxHosts int, idleTTL time.Duration) *Builder {
+	b.config.MaxHosts = maxHosts
+	b.config.HostIdleTTL = idleTTL
+	return b
+}
+
+// OnEvict registers a callback for hosts evicted from the table.
+func (b *Builder) OnEvict(fn func(host string, state *State)) *Builder {
+	b.config.OnEvict = fn
+	return b
+}
+
+// WithRetry enables automatic retries of idempotent requests (or requests
+// with GetBody). Each retry waits for the server's Retry-After and any block
+// on the host, re-acquires a concurrency slot, and respects the request
+// context deadline.
+//
+// Example:
+//
+//	client := capacitor.Wrap(nil).
+//	    WithDefaults().
+//	    WithRetry(capacitor.RetryPolicy{MaxAttempts: 5}).
+//	    Build()
+func (b *Builder) WithRetry(policy RetryPolicy) *Builder {
+	b.config.Retry = &policy
+	return b
+}
+
+// WithRetryBudget limits retries to each host to a fraction of its recent
+// successful requests plus a small floor, so retries at several layers
+// cannot multiply the load on a degraded host. Mark retries made above
+// the client with WithRetryAttempt; the built-in retries are marked.
+func (b *Builder) WithRetryBudget(budget RetryBudget) *Builder {
+	b.config.RetryBudget = &budget
+	return b
+}
+
+// WithCircuitBreaker enables a per-host circuit breaker driven by error
+// rates and backoff signals. While open, requests fail immediately with a
+// CapacityError whose Op is "circuit_open". Transitions are published
+// through OnStateChange.
+func (b *Builder) WithCircuitBreaker(cb CircuitBreaker) *Builder {
+	b.config.CircuitBreaker = &cb
+	return b
+}
+
+// WithHedging enables hedged requests: a GET or HEAD that has not
+// completed within the host's latency percentile is sent a second time,
+// and the first response wins. Hedges are only sent when the host has a
+// spare slot and is healthy.
+func (b *Builder) WithHedging(h Hedging) *Builder {
+	b.config.Hedging = &h
+	return b
+}
+
+// WithStateStore shares learned limits, block windows and rate-limit quota
+// through store, so every client using it converges on one budget.
+//
+// Example - replicas sharing state through Redis:
+//
+//	client := capacitor.Wrap(nil).
+//	    WithRateLimitHeaders().
+//	    WithStateStore(capacitor.NewKVStore(redisKV, "capacitor:")).
+//	    Build()
+func (b *Builder) WithStateStore(store StateStore) *Builder {
+	b.config.StateStore = store
+	return b
+}
+
+// OnStoreError registers a callback for StateStore failures.
+func (b *Builder) OnStoreError(fn func(key string, err error)) *Builder {
+	b.config.OnStoreError = fn
+	return b
+}
+
+// WithSnapshotFile persists learned host state to path, so a restarted
+// process resumes with the limits and block windows it had learned. State
+// is loaded by Build, written every interval (0 for the default of one
+// minute), and written again by Client.Close.
+func (b *Builder) WithSnapshotFile(path string, interval time.Duration) *Builder {
+	b.config.SnapshotFile = path
+	b.config.SnapshotInterval = interval
+	return b
+}
+
+// OnSnapshotError registers a callback for snapshot read and write failures.
+func (b *Builder) OnSnapshotError(fn func(err error)) *Builder {
+	b.config.OnSnapshotError = fn
+	return b
+}
+
+// OnRetry registers a callback for retry attempts.
+func (b *Builder) OnRetry(fn func(host string, attempt *RetryAttempt)) *Builder {
+	b.config.OnRetry = fn
+	return b
+}
+
 // OnStateChange registers a callback for state changes.
 func (b *Builder) OnStateChange(fn func(host string, state *State)) *Builder {
 	b.config.OnStateChange = fn
@@ -104,6 +361,30 @@ func (b *Builder) WithKeyFunc(fn func(u *url.URL) string) *Builder {
 	return b
 }
 
+// WithKeysFunc sets a function returning nested concurrency pools for each
+// request, broadest first. Each request takes a slot in every pool, so an
+// account-wide limit, a per-host limit and a per-endpoint limit can all be
+// enforced at once. Use level to choose which pool each signal updates;
+// if nil, signals update the last (most specific) pool.
+//
+// Example - an account-wide pool above per-endpoint pools:
+//
+//	client := capacitor.Wrap(nil).
+//	    WithKeysFunc(func(u *url.URL) []string {
+//	        return []string{"account", capacitor.PathPrefixKeyFunc(1)(u)}
+//	    }, func(keys []string, s *capacitor.Signal) int {
+//	        if s.Source == "ratelimit" {
+//	            return 0 // the quota is account-wide
+//	        }
+//	        return len(keys) - 1
+//	    }).
+//	    Build()
+func (b *Builder) WithKeysFunc(fn func(u *url.URL) []string, level func(keys []string, signal *Signal) int) *Builder {
+	b.config.KeysFunc = fn
+	b.config.SignalLevel = level
+	return b
+}
+
 // ----------------------------------------------------------------------------
 // Signal Handler Registration
 // ----------------------------------------------------------------------------
@@ -122,6 +403,15 @@ func (b *Builder) WithRateLimitHeaders() *Builder {
 	return b
 }
 
+// WithStructuredRateLimitHeaders enables rate limit header processing like
+// WithRateLimitHeaders, and additionally parses the structured-field
+// RateLimit and RateLimit-Policy headers of the current IETF draft,
+// including multiple named policies per response.
+func (b *Builder) WithStructuredRateLimitHeaders() *Builder {
+	b.handlers = append(b.handlers, &RateLimitHandler{Structured: true})
+	return b
+}
+
 // WithHTTPStatusHandling enables handling of 429, 503, 420, and Retry-After.
 func (b *Builder) WithHTTPStatusHandling() *Builder {
 	b.handlers = append(b.handlers, &HTTPStatusHandler{})
@@ -135,7 +425,8 @@ func (b *Builder) WithCapacityHeaders() *Builder {
 	return b
 }
 
-// WithGOAWAY enables HTTP/2 GOAWAY frame tracking.
+// WithGOAWAY enables HTTP/2 GOAWAY frame and connection reset tracking.
+// Transport errors are fed through the signal pipeline like responses.
 func (b *Builder) WithGOAWAY() *Builder {
 	b.config.EnableGOAWAYHandling = true
 	return b
@@ -73,6 +73,18 @@ func (c *Client) GetStats() map[string]Stats {
 	return c.transport.GetStats()
 }
 
+// GetAggregateStats returns statistics summed across all hosts, including
+// the client-wide concurrency limit.
+func (c *Client) GetAggregateStats() AggregateStats {
+	return c.transport.GetAggregateStats()
+}
+
+// Close writes a final snapshot of host state if a SnapshotFile is
+// configured and stops periodic snapshots. Call it on shutdown.
+func (c *Client) Close() error {
+	return c.transport.Close()
+}
+
 // Transport returns the underlying capacity-aware transport.
 func (c *Client) Transport() *Transport {
 	return c.transport
@@ -1,10 +1,17 @@
 package capacitor_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -269,6 +276,407 @@ func TestSemaphore_Resize(t *testing.T) {
 	}
 }
 
+// waitFor polls until sem has n waiters.
+func waitFor(t *testing.T, sem *capacitor.Semaphore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for sem.Waiting() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters, got %d", n, sem.Waiting())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSemaphore_FIFO(t *testing.T) {
+	sem := capacitor.NewSemaphore(1)
+	ctx := context.Background()
+	sem.Acquire(ctx)
+
+	order := make(chan int, 50)
+	for i := 0; i < 50; i++ {
+		go func(i int) {
+			sem.Acquire(ctx)
+			order <- i
+			sem.Release()
+		}(i)
+		waitFor(t, sem, i+1)
+	}
+
+	sem.Release()
+
+	for want := 0; want < 50; want++ {
+		if got := <-order; got != want {
+			t.Fatalf("expected waiter %d to be granted next, got %d", want, got)
+		}
+	}
+}
+
+func TestSemaphore_Priority(t *testing.T) {
+	sem := capacitor.NewSemaphore(1)
+	sem.SetAging(0)
+
+	ctx := context.Background()
+	sem.Acquire(ctx)
+
+	// Queue low priority waiters first, then a high priority one
+	order := make(chan capacitor.Priority, 3)
+	acquire := func(p capacitor.Priority) {
+		sem.Acquire(capacitor.WithPriority(ctx, p))
+		order <- p
+		sem.Release()
+	}
+	go acquire(capacitor.PriorityLow)
+	waitFor(t, sem, 1)
+	go acquire(capacitor.PriorityLow)
+	waitFor(t, sem, 2)
+	go acquire(capacitor.PriorityHigh)
+	waitFor(t, sem, 3)
+
+	counts := sem.WaitingByPriority()
+	if counts[capacitor.PriorityLow] != 2 || counts[capacitor.PriorityHigh] != 1 {
+		t.Errorf("unexpected per-priority waiting counts: %v", counts)
+	}
+
+	sem.Release()
+
+	want := []capacitor.Priority{capacitor.PriorityHigh, capacitor.PriorityLow, capacitor.PriorityLow}
+	for i, p := range want {
+		select {
+		case got := <-order:
+			if got != p {
+				t.Errorf("grant %d: expected priority %d, got %d", i, p, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for grant")
+		}
+	}
+}
+
+func TestSemaphore_PriorityAging(t *testing.T) {
+	sem := capacitor.NewSemaphore(1)
+	sem.SetAging(20 * time.Millisecond)
+
+	ctx := context.Background()
+	sem.Acquire(ctx)
+
+	order := make(chan capacitor.Priority, 2)
+	acquire := func(p capacitor.Priority) {
+		sem.Acquire(capacitor.WithPriority(ctx, p))
+		order <- p
+		sem.Release()
+	}
+
+	// A low priority waiter that has waited long enough outranks a new
+	// normal priority one
+	go acquire(capacitor.PriorityLow)
+	waitFor(t, sem, 1)
+	time.Sleep(50 * time.Millisecond)
+	go acquire(capacitor.PriorityNormal)
+	waitFor(t, sem, 2)
+
+	sem.Release()
+
+	if got := <-order; got != capacitor.PriorityLow {
+		t.Errorf("expected aged low priority waiter first, got %d", got)
+	}
+	<-order
+}
+
+func TestSemaphore_CancelledWaiter(t *testing.T) {
+	sem := capacitor.NewSemaphore(1)
+	sem.Acquire(context.Background())
+
+	ctx, cancel := context.WithCancel(capacitor.WithPriority(context.Background(), capacitor.PriorityHigh))
+	errc := make(chan error, 1)
+	go func() { errc <- sem.Acquire(ctx) }()
+	waitFor(t, sem, 1)
+
+	acquired := make(chan struct{})
+	go func() {
+		sem.Acquire(context.Background())
+		close(acquired)
+	}()
+	waitFor(t, sem, 2)
+
+	// Cancelling the head of the queue must not strand the waiter behind it
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	sem.Release()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("waiter behind cancelled waiter was not granted the slot")
+	}
+	if n := sem.Waiting(); n != 0 {
+		t.Errorf("expected 0 waiting, got %d", n)
+	}
+}
+
+func TestSemaphore_FairFlows(t *testing.T) {
+	sem := capacitor.NewSemaphore(1)
+	ctx := context.Background()
+	sem.Acquire(ctx)
+
+	order := make(chan string, 6)
+	acquire := func(flow string) {
+		sem.Acquire(capacitor.WithFlow(ctx, flow))
+		order <- flow
+		sem.Release()
+	}
+
+	// A noisy flow queues first, then a quiet one
+	for i := 0; i < 4; i++ {
+		go acquire("noisy")
+		waitFor(t, sem, i+1)
+	}
+	for i := 0; i < 2; i++ {
+		go acquire("quiet")
+		waitFor(t, sem, i+5)
+	}
+
+	counts := sem.WaitingByFlow()
+	if counts["noisy"] != 4 || counts["quiet"] != 2 {
+		t.Errorf("unexpected per-flow waiting counts: %v", counts)
+	}
+
+	sem.Release()
+
+	want := []string{"noisy", "quiet", "noisy", "quiet", "noisy", "noisy"}
+	for i, flow := range want {
+		select {
+		case got := <-order:
+			if got != flow {
+				t.Errorf("grant %d: expected flow %q, got %q", i, flow, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for grant")
+		}
+	}
+	if counts := sem.WaitingByFlow(); len(counts) != 0 {
+		t.Errorf("expected no waiting flows, got %v", counts)
+	}
+}
+
+func TestSemaphore_AcquireN(t *testing.T) {
+	sem := capacitor.NewSemaphore(4)
+	ctx := context.Background()
+
+	if err := sem.AcquireN(ctx, 3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sem.TryAcquireN(2) {
+		t.Fatal("expected TryAcquireN(2) to fail with 1 slot available")
+	}
+
+	// A heavy waiter holds back lighter requests queued behind it
+	acquired := make(chan struct{})
+	go func() {
+		sem.AcquireN(ctx, 2)
+		close(acquired)
+	}()
+	waitFor(t, sem, 1)
+
+	if sem.TryAcquire() {
+		t.Error("expected TryAcquire not to jump ahead of the queued waiter")
+	}
+
+	sem.ReleaseN(3)
+	<-acquired
+	if n := sem.InUse(); n != 2 {
+		t.Errorf("expected 2 in use, got %d", n)
+	}
+}
+
+func TestSemaphore_AcquireNLargerThanCapacity(t *testing.T) {
+	sem := capacitor.NewSemaphore(4)
+	ctx := context.Background()
+	sem.Acquire(ctx)
+
+	acquired := make(chan struct{})
+	go func() {
+		sem.AcquireN(ctx, 4)
+		close(acquired)
+	}()
+	waitFor(t, sem, 1)
+
+	// Shrinking below the outstanding request must not strand it
+	sem.Resize(2)
+	select {
+	case <-acquired:
+		t.Fatal("expected heavy waiter to wait for the held slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	sem.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected heavy waiter to run alone once the semaphore drained")
+	}
+	if n := sem.InUse(); n != 4 {
+		t.Errorf("expected 4 in use, got %d", n)
+	}
+
+	sem.ReleaseN(4)
+	if n := sem.Available(); n != 2 {
+		t.Errorf("expected 2 available after release, got %d", n)
+	}
+}
+
+// semaphore is the part of Semaphore exercised by benchmarkSemaphore.
+type semaphore interface {
+	Acquire(ctx context.Context) error
+	Release()
+}
+
+// condSemaphore is the cond-based semaphore Semaphore replaced, kept as a
+// baseline for its benchmarks: every release wakes all waiters, each wait
+// spawns a goroutine to watch its context, and the next waiter is found by
+// scanning the whole queue.
+type condSemaphore struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	max     int
+	current int
+	queue   []uint64
+	seq     uint64
+}
+
+func newCondSemaphore(n int) *condSemaphore {
+	s := &condSemaphore{max: n}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *condSemaphore) Acquire(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 && s.current < s.max {
+		s.current++
+		return nil
+	}
+
+	seq := s.seq
+	s.seq++
+	s.queue = append(s.queue, seq)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	for s.current >= s.max || s.head() != seq {
+		if err := ctx.Err(); err != nil {
+			s.remove(seq)
+			s.cond.Broadcast()
+			return err
+		}
+		s.cond.Wait()
+	}
+
+	s.current++
+	s.remove(seq)
+	if s.current < s.max && len(s.queue) > 0 {
+		s.cond.Broadcast()
+	}
+	return nil
+}
+
+func (s *condSemaphore) head() uint64 {
+	best := s.queue[0]
+	for _, seq := range s.queue {
+		if seq < best {
+			best = seq
+		}
+	}
+	return best
+}
+
+func (s *condSemaphore) remove(seq uint64) {
+	for i, q := range s.queue {
+		if q == seq {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *condSemaphore) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current > 0 {
+		s.current--
+		s.cond.Broadcast()
+	}
+}
+
+// benchmarkSemaphore runs b.N acquire/release cycles spread across the
+// given number of goroutines contending for 10 slots.
+func benchmarkSemaphore(b *testing.B, sem semaphore, goroutines int) {
+	ctx := context.Background()
+
+	var remaining atomic.Int64
+	remaining.Store(int64(b.N))
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for remaining.Add(-1) >= 0 {
+				if err := sem.Acquire(ctx); err != nil {
+					b.Error(err)
+					return
+				}
+				runtime.Gosched() // hold the slot while others queue
+				sem.Release()
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	close(start)
+	wg.Wait()
+}
+
+func BenchmarkSemaphore_100Waiters(b *testing.B) {
+	benchmarkSemaphore(b, capacitor.NewSemaphore(10), 100)
+}
+
+func BenchmarkSemaphore_1000Waiters(b *testing.B) {
+	benchmarkSemaphore(b, capacitor.NewSemaphore(10), 1000)
+}
+
+func BenchmarkSemaphore_5000Waiters(b *testing.B) {
+	benchmarkSemaphore(b, capacitor.NewSemaphore(10), 5000)
+}
+
+func BenchmarkCondSemaphore_100Waiters(b *testing.B) {
+	benchmarkSemaphore(b, newCondSemaphore(10), 100)
+}
+
+func BenchmarkCondSemaphore_1000Waiters(b *testing.B) {
+	benchmarkSemaphore(b, newCondSemaphore(10), 1000)
+}
+
+func BenchmarkCondSemaphore_5000Waiters(b *testing.B) {
+	benchmarkSemaphore(b, newCondSemaphore(10), 5000)
+}
+
 func TestTransport_MultipleHosts(t *testing.T) {
 	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Capacity-Status", "healthy")
@@ -309,3 +717,1717 @@ func TestTransport_MultipleHosts(t *testing.T) {
 		t.Errorf("expected server2 busy, got %s", state2.Status)
 	}
 }
+
+func TestClient_BlockWait(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).WithHTTPStatusHandling().Build()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if !client.GetState(server.URL).IsBlocked() {
+		t.Fatal("expected host to be blocked after Retry-After")
+	}
+
+	start := time.Now()
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("expected request to wait for block to expire, took %v", elapsed)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestClient_SlowStart(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithHTTPStatusHandling().
+		WithConcurrency(10, 1, 20).
+		WithSlowStart(400*time.Millisecond, 0).
+		Build()
+
+	get := func() {
+		t.Helper()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	state := client.GetState(server.URL)
+	if !state.IsBlocked() {
+		t.Fatal("expected host to be blocked after Retry-After")
+	}
+	if state.CurrentConcurrency != 1 {
+		t.Errorf("expected concurrency to drop to 1 while blocked, got %d", state.CurrentConcurrency)
+	}
+
+	// Halfway through the window the limit has partly recovered
+	time.Sleep(time.Until(state.GetBlockedUntil()) + 200*time.Millisecond)
+	get()
+	if c := client.GetState(server.URL).CurrentConcurrency; c <= 1 || c >= 10 {
+		t.Errorf("expected concurrency between 1 and 10 during slow start, got %d", c)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	get()
+	if c := client.GetState(server.URL).CurrentConcurrency; c != 10 {
+		t.Errorf("expected concurrency back to 10 after slow start, got %d", c)
+	}
+}
+
+func TestClient_SlowStartKeysFunc(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithHTTPStatusHandling().
+		WithConcurrency(8, 1, 8).
+		WithKeysFunc(func(u *url.URL) []string {
+			return []string{"account", capacitor.HostKeyFunc(u)}
+		}, func(keys []string, s *capacitor.Signal) int {
+			return 0 // the rate limit is account-wide
+		}).
+		WithSlowStart(200*time.Millisecond, 0).
+		Build()
+
+	get := func() {
+		t.Helper()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	state := client.GetState("account")
+	if !state.IsBlocked() || state.CurrentConcurrency != 1 {
+		t.Fatalf("expected account pool blocked at concurrency 1, got blocked %v concurrency %d", state.IsBlocked(), state.CurrentConcurrency)
+	}
+
+	time.Sleep(time.Until(state.GetBlockedUntil()) + 300*time.Millisecond)
+	get()
+	if c := client.GetState("account").CurrentConcurrency; c != 8 {
+		t.Errorf("expected account pool back to 8 after slow start, got %d", c)
+	}
+}
+
+func TestClient_BlockJitter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithHTTPStatusHandling().
+		WithBlockMode(capacitor.BlockModeFailFast).
+		WithSlowStart(0, time.Second).
+		Build()
+
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	until := client.GetState(server.URL).GetBlockedUntil()
+	if until.Before(start.Add(time.Second)) || until.After(time.Now().Add(2*time.Second)) {
+		t.Errorf("expected block to end between 1s and 2s from now, got %v", time.Until(until))
+	}
+}
+
+func TestClient_BlockFailFast(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", "60")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithRateLimitHeaders().
+		WithBlockMode(capacitor.BlockModeFailFast).
+		Build()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	_, err = client.Get(server.URL)
+	if !capacitor.IsBlockedError(err) {
+		t.Fatalf("expected BlockedError, got %T: %v", err, err)
+	}
+
+	var blocked *capacitor.BlockedError
+	errors.As(err, &blocked)
+	if blocked.RetryAfter() <= 50*time.Second {
+		t.Errorf("expected retry after ~60s, got %v", blocked.RetryAfter())
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("expected blocked request not to reach server, got %d requests", n)
+	}
+}
+
+func TestClient_ReleaseOnBodyClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("streaming body"))
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).WithReleaseOnBodyClose().Build()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if inUse := client.GetStats()[server.URL].InUse; inUse != 1 {
+		t.Errorf("expected slot held while body is open, got %d in use", inUse)
+	}
+
+	resp.Body.Close()
+
+	if inUse := client.GetStats()[server.URL].InUse; inUse != 0 {
+		t.Errorf("expected slot released after close, got %d in use", inUse)
+	}
+}
+
+func TestClient_ReleaseOnBodyEOF(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).WithReleaseOnBodyClose().Build()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if inUse := client.GetStats()[server.URL].InUse; inUse != 0 {
+		t.Errorf("expected slot released at EOF, got %d in use", inUse)
+	}
+}
+
+func TestClient_ReleaseOnBodyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The caller gives up just as the response headers arrive
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		cancel()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("body")),
+			Request:    req,
+		}, nil
+	})
+	client := capacitor.Wrap(&http.Client{Transport: base}).WithReleaseOnBodyClose().Build()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+	resp, err := client.Transport().RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for client.GetStats()["http://example.com"].InUse != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if inUse := client.GetStats()["http://example.com"].InUse; inUse != 0 {
+		t.Errorf("expected slot released for a cancelled context, got %d in use", inUse)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestClient_GOAWAY(t *testing.T) {
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("http2: server sent GOAWAY and closed the connection")
+	})
+
+	var signals []*capacitor.Signal
+	client := capacitor.Wrap(&http.Client{Transport: base}).
+		WithConcurrency(10, 2, 10).
+		WithGOAWAY().
+		OnSignal(func(host string, signal *capacitor.Signal) {
+			signals = append(signals, signal)
+		}).
+		Build()
+
+	_, err := client.Get("https://api.example.com/data")
+	if err == nil {
+		t.Fatal("expected transport error")
+	}
+
+	if len(signals) != 1 || signals[0].Source != "http2" {
+		t.Fatalf("expected one http2 signal, got %v", signals)
+	}
+
+	state := client.GetState("https://api.example.com")
+	if state == nil {
+		t.Fatal("expected state to be set")
+	}
+	if !state.IsBlocked() {
+		t.Error("expected host to be blocked after GOAWAY")
+	}
+	if state.CurrentConcurrency != 5 {
+		t.Errorf("expected concurrency halved to 5, got %d", state.CurrentConcurrency)
+	}
+}
+
+func TestClient_Recovery(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var steps []int
+	client := capacitor.Wrap(nil).
+		WithHTTPStatusHandling().
+		WithConcurrency(4, 1, 10).
+		WithStateExpiry(50 * time.Millisecond).
+		WithRecovery(capacitor.ExponentialRecovery(2)).
+		OnStateChange(func(host string, state *capacitor.State) {
+			mu.Lock()
+			steps = append(steps, state.CurrentConcurrency)
+			mu.Unlock()
+		}).
+		Build()
+
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		time.Sleep(60 * time.Millisecond)
+	}
+
+	if state := client.GetState(server.URL); state.CurrentConcurrency != 4 {
+		t.Errorf("expected concurrency recovered to 4, got %d", state.CurrentConcurrency)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []int{1, 2, 4}
+	if len(steps) != len(want) {
+		t.Fatalf("expected steps %v, got %v", want, steps)
+	}
+	for i := range want {
+		if steps[i] != want[i] {
+			t.Errorf("step %d: expected %d, got %d", i, want[i], steps[i])
+		}
+	}
+}
+
+func TestClient_Backoff(t *testing.T) {
+	var unavailable atomic.Bool
+	unavailable.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithHTTPStatusHandling().
+		WithConcurrency(16, 1, 16).
+		WithBackoff(0.5, 200*time.Millisecond, time.Second).
+		WithBlockMode(capacitor.BlockModeFailFast).
+		Build()
+
+	// First backoff halves concurrency without blocking
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	state := client.GetState(server.URL)
+	if state.CurrentConcurrency != 8 {
+		t.Errorf("expected concurrency halved to 8, got %d", state.CurrentConcurrency)
+	}
+	if state.IsBlocked() {
+		t.Error("expected first backoff not to block")
+	}
+
+	// Second backoff halves again and blocks for a jittered window
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	state = client.GetState(server.URL)
+	if state.CurrentConcurrency != 4 {
+		t.Errorf("expected concurrency halved to 4, got %d", state.CurrentConcurrency)
+	}
+	window := time.Until(state.BlockedUntil)
+	if window < 90*time.Millisecond || window > 200*time.Millisecond {
+		t.Errorf("expected block window in [100ms, 200ms), got %v", window)
+	}
+
+	if _, err := client.Get(server.URL); !capacitor.IsBlockedError(err) {
+		t.Errorf("expected BlockedError during backoff window, got %v", err)
+	}
+}
+
+func TestClient_BackoffBlockShared(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	store := capacitor.NewMemoryStore()
+	client := capacitor.Wrap(nil).
+		WithHTTPStatusHandling().
+		WithConcurrency(16, 1, 16).
+		WithBackoff(0.5, 200*time.Millisecond, time.Second).
+		WithSlowStart(time.Second, 0).
+		WithStateStore(store).
+		Build()
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// The backoff window is handled like any other block
+	state := client.GetState(server.URL)
+	if !state.IsBlocked() {
+		t.Fatal("expected second backoff to block")
+	}
+	if state.CurrentConcurrency != 1 {
+		t.Errorf("expected slow start to drop concurrency to 1, got %d", state.CurrentConcurrency)
+	}
+	shared, err := store.Load(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if shared == nil || !shared.BlockedUntil.Equal(state.BlockedUntil) {
+		t.Errorf("expected backoff block shared through the store, got %+v", shared)
+	}
+}
+
+func TestClient_HostEvictionLRU(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	servers := make([]*httptest.Server, 3)
+	for i := range servers {
+		servers[i] = httptest.NewServer(handler)
+		defer servers[i].Close()
+	}
+
+	var evicted []string
+	client := capacitor.Wrap(nil).
+		WithHostEviction(2, 0).
+		OnEvict(func(host string, state *capacitor.State) {
+			evicted = append(evicted, host)
+		}).
+		Build()
+
+	for _, server := range servers {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if n := len(client.GetStats()); n != 2 {
+		t.Errorf("expected 2 hosts tracked, got %d", n)
+	}
+	if len(evicted) != 1 || evicted[0] != servers[0].URL {
+		t.Errorf("expected %s evicted, got %v", servers[0].URL, evicted)
+	}
+}
+
+func TestClient_HostEvictionRecency(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	servers := make([]*httptest.Server, 4)
+	for i := range servers {
+		servers[i] = httptest.NewServer(handler)
+		defer servers[i].Close()
+	}
+
+	var evicted []string
+	client := capacitor.Wrap(nil).
+		WithReleaseOnBodyClose().
+		WithHostEviction(3, 0).
+		OnEvict(func(host string, state *capacitor.State) {
+			evicted = append(evicted, host)
+		}).
+		Build()
+
+	get := func(u string) *http.Response {
+		t.Helper()
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	// servers[0] is the least recently used but has a request in flight,
+	// and servers[2] was used again after servers[1]
+	held := get(servers[0].URL)
+	defer held.Body.Close()
+	get(servers[1].URL).Body.Close()
+	get(servers[2].URL).Body.Close()
+	get(servers[1].URL).Body.Close()
+	get(servers[2].URL).Body.Close()
+
+	get(servers[3].URL).Body.Close()
+
+	if len(evicted) != 1 || evicted[0] != servers[1].URL {
+		t.Errorf("expected %s evicted, got %v", servers[1].URL, evicted)
+	}
+}
+
+func TestClient_HostEvictionIdleTTL(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	server1 := httptest.NewServer(handler)
+	defer server1.Close()
+	server2 := httptest.NewServer(handler)
+	defer server2.Close()
+
+	client := capacitor.Wrap(nil).
+		WithReleaseOnBodyClose().
+		WithHostEviction(0, 50*time.Millisecond).
+		Build()
+
+	// Hold a slot on server1 so it is never idle
+	held, err := client.Get(server1.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	resp, err := client.Get(server2.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if client.GetState(server1.URL) == nil {
+		t.Error("expected host with in-use slot not to be evicted")
+	}
+
+	held.Body.Close()
+	time.Sleep(60 * time.Millisecond)
+
+	resp, err = client.Get(server2.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	// Sweeps run when a new host is added
+	server3 := httptest.NewServer(handler)
+	defer server3.Close()
+	resp, err = client.Get(server3.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if client.GetState(server1.URL) != nil {
+		t.Error("expected idle host to be evicted")
+	}
+	if client.GetState(server2.URL) == nil {
+		t.Error("expected recently used host to be kept")
+	}
+}
+
+func TestClient_Pacing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.Header().Set("X-RateLimit-Remaining", "50")
+		w.Header().Set("X-RateLimit-Reset", "5")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithRateLimitHeaders().
+		WithPacing(1).
+		Build()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// 50 requests remaining over 5s paces at 100ms; the first two go
+	// immediately and the next two each wait one interval
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("expected requests to be paced, took %v", elapsed)
+	}
+
+	interval := client.GetStats()[server.URL].PaceInterval
+	if interval < 90*time.Millisecond || interval > 100*time.Millisecond {
+		t.Errorf("expected pace interval ~100ms, got %v", interval)
+	}
+}
+
+func TestClient_RateLimitResources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "30")
+		w.Header().Set("X-RateLimit-Reset", "60")
+		if strings.HasPrefix(r.URL.Path, "/search/") {
+			w.Header().Set("X-RateLimit-Resource", "search")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+		} else {
+			w.Header().Set("X-RateLimit-Resource", "core")
+			w.Header().Set("X-RateLimit-Remaining", "29")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithRateLimitHeaders().
+		WithBlockMode(capacitor.BlockModeFailFast).
+		Build()
+
+	resp, err := client.Get(server.URL + "/search/issues?q=bug")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	// The search quota is exhausted
+	if _, err := client.Get(server.URL + "/search/issues?q=feature"); !capacitor.IsBlockedError(err) {
+		t.Errorf("expected search request to be blocked, got %v", err)
+	}
+
+	// Core requests through the same host are unaffected
+	resp, err = client.Get(server.URL + "/repos/syntaqx/capacitor")
+	if err != nil {
+		t.Fatalf("expected core request to succeed, got %v", err)
+	}
+	resp.Body.Close()
+
+	stats := client.GetStats()[server.URL]
+	if !stats.Resources["search"].BlockedUntil.After(time.Now()) {
+		t.Error("expected search resource to be blocked in stats")
+	}
+	if core := stats.Resources["core"]; core.Remaining != 29 || core.Limit != 30 {
+		t.Errorf("expected core quota 29/30, got %d/%d", core.Remaining, core.Limit)
+	}
+	if client.GetState(server.URL).IsBlocked() {
+		t.Error("expected host itself not to be blocked")
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt64(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	var attempts []*capacitor.RetryAttempt
+	client := capacitor.Wrap(nil).
+		WithHTTPStatusHandling().
+		WithRetry(capacitor.RetryPolicy{MaxAttempts: 3, MinDelay: 10 * time.Millisecond}).
+		OnRetry(func(host string, attempt *capacitor.RetryAttempt) {
+			attempts = append(attempts, attempt)
+		}).
+		Build()
+
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "payload" {
+		t.Errorf("expected 200 with replayed body, got %d %q", resp.StatusCode, body)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("expected 2 retries, got %d", len(attempts))
+	}
+	if attempts[0].Attempt != 2 || attempts[0].StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected first retry: %+v", attempts[0])
+	}
+}
+
+func TestClient_RetryUserAgent(t *testing.T) {
+	var mu sync.Mutex
+	var agents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.Header.Get("User-Agent"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithUserAgent("cap/1").
+		WithHTTPStatusHandling().
+		WithRetry(capacitor.RetryPolicy{MaxAttempts: 3, MinDelay: 10 * time.Millisecond}).
+		Build()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("User-Agent", "app")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(agents) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(agents))
+	}
+	for i, agent := range agents {
+		if agent != "cap/1 app" {
+			t.Errorf("attempt %d: expected User-Agent %q, got %q", i+1, "cap/1 app", agent)
+		}
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "app" {
+		t.Errorf("expected caller's request left unmodified, got User-Agent %q", ua)
+	}
+}
+
+type onceReader struct{ io.Reader }
+
+func TestClient_RetrySkipsUnreplayable(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithRetry(capacitor.RetryPolicy{MinDelay: time.Millisecond}).
+		Build()
+
+	// A POST whose body cannot be rewound must not be retried
+	resp, err := client.Post(server.URL, "text/plain", onceReader{strings.NewReader("payload")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+}
+
+func TestClient_RetryRespectsMaxDelay(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithHTTPStatusHandling().
+		WithRetry(capacitor.RetryPolicy{MaxDelay: time.Second}).
+		Build()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429 returned, got %d", resp.StatusCode)
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("expected no retry beyond MaxDelay, got %d requests", n)
+	}
+}
+
+func TestClient_RetryBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithRetryBudget(capacitor.RetryBudget{Ratio: 0.5, MinRetries: 2, Window: time.Minute}).
+		Build()
+
+	get := func(attempt int) error {
+		ctx := capacitor.WithRetryAttempt(context.Background(), attempt)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// Two successes allow 2 + 2*0.5 = 3 retries
+	for i := 0; i < 2; i++ {
+		if err := get(1); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := get(2); err != nil {
+			t.Fatalf("retry %d: unexpected error: %v", i, err)
+		}
+	}
+
+	err := get(2)
+	var capErr *capacitor.CapacityError
+	if !errors.As(err, &capErr) || capErr.Op != "retry_budget" {
+		t.Fatalf("expected retry_budget CapacityError, got %v", err)
+	}
+	if !errors.Is(err, capacitor.ErrRetryBudgetExhausted) {
+		t.Errorf("expected ErrRetryBudgetExhausted, got %v", err)
+	}
+
+	stats := client.GetStats()[server.URL]
+	if stats.Retries != 3 || stats.RetryBudget != 3 {
+		t.Errorf("expected 3 retries of 3 allowed, got %d of %d", stats.Retries, stats.RetryBudget)
+	}
+}
+
+func TestClient_RetryBudgetUnsent(t *testing.T) {
+	hold := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-hold
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.NewClient(&capacitor.Config{
+		InitialConcurrency: 1,
+		AcquireTimeout:     50 * time.Millisecond,
+		RetryBudget:        &capacitor.RetryBudget{MinRetries: 1, Window: time.Minute},
+	})
+
+	retry := func() error {
+		ctx := capacitor.WithRetryAttempt(context.Background(), 2)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// Hold the only slot so the retry times out before it is sent
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := client.Get(server.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	err := retry()
+	var capErr *capacitor.CapacityError
+	if !errors.As(err, &capErr) || capErr.Op != "acquire" {
+		t.Fatalf("expected acquire CapacityError, got %v", err)
+	}
+	close(hold)
+	<-done
+
+	// The unsent retry left the budget untouched
+	if err := retry(); err != nil {
+		t.Fatalf("expected retry within budget, got %v", err)
+	}
+	if n := client.GetStats()[server.URL].Retries; n != 1 {
+		t.Errorf("expected 1 retry spent, got %d", n)
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var transitions []capacitor.BreakerState
+	client := capacitor.Wrap(nil).
+		WithCircuitBreaker(capacitor.CircuitBreaker{
+			MinRequests: 4,
+			OpenTimeout: 50 * time.Millisecond,
+		}).
+		OnStateChange(func(host string, state *capacitor.State) {
+			mu.Lock()
+			transitions = append(transitions, state.Breaker)
+			mu.Unlock()
+		}).
+		Build()
+
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if b := client.GetStats()[server.URL].Breaker; b != capacitor.BreakerOpen {
+		t.Fatalf("expected breaker open, got %q", b)
+	}
+
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, capacitor.ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 4 {
+		t.Errorf("expected open breaker to reject without sending, got %d requests", n)
+	}
+
+	// After the open timeout a successful probe closes the breaker
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected probe to be admitted, got %v", err)
+	}
+	resp.Body.Close()
+
+	if b := client.GetState(server.URL).Breaker; b != capacitor.BreakerClosed {
+		t.Errorf("expected breaker closed after probe, got %q", b)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []capacitor.BreakerState{capacitor.BreakerOpen, capacitor.BreakerHalfOpen, capacitor.BreakerClosed}
+	if len(transitions) != len(want) {
+		t.Fatalf("expected transitions %v, got %v", want, transitions)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Errorf("transition %d: expected %q, got %q", i, want[i], transitions[i])
+		}
+	}
+}
+
+func TestClient_CircuitBreakerCancelledProbe(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithCircuitBreaker(capacitor.CircuitBreaker{
+			MinRequests: 4,
+			OpenTimeout: 50 * time.Millisecond,
+		}).
+		Build()
+
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if b := client.GetState(server.URL).Breaker; b != capacitor.BreakerOpen {
+		t.Fatalf("expected breaker open, got %q", b)
+	}
+
+	// A probe cancelled by its caller neither closes the breaker nor uses
+	// up the half-open probe
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/slow", nil)
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if b := client.GetState(server.URL).Breaker; b != capacitor.BreakerHalfOpen {
+		t.Fatalf("expected breaker half-open after cancelled probe, got %q", b)
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected a new probe to be admitted, got %v", err)
+	}
+	resp.Body.Close()
+	if b := client.GetState(server.URL).Breaker; b != capacitor.BreakerClosed {
+		t.Errorf("expected breaker closed after probe, got %q", b)
+	}
+}
+
+func TestClient_Hedging(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt after warm-up stalls until it is cancelled
+		if atomic.AddInt64(&requests, 1) == 6 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithHedging(capacitor.Hedging{
+			MinSamples: 5,
+			MinDelay:   20 * time.Millisecond,
+		}).
+		Build()
+
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if n := client.GetStats()[server.URL].Hedges; n != 0 {
+		t.Fatalf("expected no hedges for fast requests, got %d", n)
+	}
+
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "ok" {
+		t.Errorf("expected hedged response body, got %q", body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected hedge to answer quickly, took %v", elapsed)
+	}
+	if n := client.GetStats()[server.URL].Hedges; n != 1 {
+		t.Errorf("expected 1 hedge, got %d", n)
+	}
+
+	// The cancelled attempt's slot is returned
+	deadline := time.Now().Add(time.Second)
+	for client.GetStats()[server.URL].InUse != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := client.GetStats()[server.URL].InUse; n != 0 {
+		t.Errorf("expected all slots released, got %d in use", n)
+	}
+}
+
+func TestClient_HedgingSkipsPost(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) > 5 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithHedging(capacitor.Hedging{MinSamples: 5}).
+		Build()
+
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if n := atomic.LoadInt64(&requests); n != 6 {
+		t.Errorf("expected POST to be sent once, got %d requests", n-5)
+	}
+}
+
+func TestClient_RequestCost(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithConcurrency(5, 1, 5).
+		WithCostFunc(func(req *http.Request) int { return 2 }).
+		Build()
+
+	get := func(ctx context.Context) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		get(capacitor.WithCost(context.Background(), 4))
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		get(context.Background())
+	}()
+
+	// The context cost overrides the cost function, so the second request
+	// (cost 2) cannot fit beside the first (cost 4)
+	deadline := time.Now().Add(time.Second)
+	for client.GetStats()[server.URL].Waiting != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stats := client.GetStats()[server.URL]
+	if stats.InUse != 4 || stats.Waiting != 1 {
+		t.Errorf("expected 4 in use and 1 waiting, got %d in use and %d waiting", stats.InUse, stats.Waiting)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := client.GetStats()[server.URL].InUse; n != 0 {
+		t.Errorf("expected all slots released, got %d in use", n)
+	}
+}
+
+func TestClient_LoadShedding(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithConcurrency(1, 1, 1).
+		WithLoadShedding(1, 0).
+		Build()
+
+	// One request in flight and one queued fill the host
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for client.GetStats()[server.URL].Waiting != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := client.Get(server.URL)
+	var capErr *capacitor.CapacityError
+	if !errors.As(err, &capErr) || capErr.Op != "shed" {
+		t.Fatalf("expected shed CapacityError, got %v", err)
+	}
+	if !errors.Is(err, capacitor.ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := client.GetStats()[server.URL].Shed; n != 1 {
+		t.Errorf("expected 1 shed request, got %d", n)
+	}
+}
+
+func TestClient_LoadSheddingMaxWait(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := capacitor.Wrap(nil).
+		WithConcurrency(1, 1, 1).
+		WithLoadShedding(0, 20*time.Millisecond).
+		Build()
+
+	go func() {
+		if resp, err := client.Get(server.URL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for client.GetStats()[server.URL].InUse != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, capacitor.ErrQueueTimeout) {
+		t.Fatalf("expected ErrQueueTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected shed after max wait, took %v", elapsed)
+	}
+}
+
+func TestClient_DeadlineShedding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithConcurrency(1, 1, 1).
+		WithDeadlineShedding().
+		Build()
+
+	// Learn the host's latency
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if resp, err := client.Get(server.URL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for client.GetStats()[server.URL].InUse != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A slot won't free up for ~100ms, so a 20ms deadline cannot be met
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+
+	start := time.Now()
+	_, err = client.Do(req)
+	if !errors.Is(err, capacitor.ErrDeadlineUnreachable) {
+		t.Fatalf("expected ErrDeadlineUnreachable, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 20*time.Millisecond {
+		t.Errorf("expected rejection before the deadline, took %v", elapsed)
+	}
+
+	// A slot frees up within 150ms, but the request itself then takes
+	// another ~100ms
+	ctx, cancel = context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if _, err = client.Do(req); !errors.Is(err, capacitor.ErrDeadlineUnreachable) {
+		t.Errorf("expected ErrDeadlineUnreachable counting the request's own latency, got %v", err)
+	}
+	wg.Wait()
+}
+
+func TestClient_MaxTotalConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	})
+	server1 := httptest.NewServer(handler)
+	defer server1.Close()
+	server2 := httptest.NewServer(handler)
+	defer server2.Close()
+
+	client := capacitor.Wrap(nil).
+		WithConcurrency(5, 1, 5).
+		WithMaxTotalConcurrency(2).
+		Build()
+
+	var wg sync.WaitGroup
+	for _, url := range []string{server1.URL, server1.URL, server2.URL, server2.URL} {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}(url)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for client.GetAggregateStats().GlobalWaiting != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	stats := client.GetAggregateStats()
+	if stats.Hosts != 2 || stats.Limit != 2 {
+		t.Errorf("expected 2 hosts and a limit of 2, got %+v", stats)
+	}
+	if stats.GlobalInUse != 2 || stats.GlobalWaiting != 2 {
+		t.Errorf("expected 2 in flight and 2 waiting client-wide, got %+v", stats)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if stats := client.GetAggregateStats(); stats.GlobalInUse != 0 || stats.InUse != 0 {
+		t.Errorf("expected all slots released, got %+v", stats)
+	}
+}
+
+func TestClient_KeysFunc(t *testing.T) {
+	var release atomic.Value
+	release.Store(make(chan struct{}))
+	close(release.Load().(chan struct{}))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release.Load().(chan struct{})
+		w.Header().Set("X-Capacity-Suggested-Concurrency", "1")
+		w.Write([]byte("ok"))
+	})
+	server1 := httptest.NewServer(handler)
+	defer server1.Close()
+	server2 := httptest.NewServer(handler)
+	defer server2.Close()
+
+	var signals sync.Map
+	client := capacitor.Wrap(nil).
+		WithConcurrency(5, 1, 5).
+		WithCapacityHeaders().
+		WithKeysFunc(func(u *url.URL) []string {
+			return []string{"account", capacitor.HostKeyFunc(u)}
+		}, func(keys []string, s *capacitor.Signal) int {
+			return 0 // the suggestion is account-wide
+		}).
+		OnSignal(func(host string, signal *capacitor.Signal) {
+			signals.Store(host, true)
+		}).
+		Build()
+
+	for _, u := range []string{server1.URL, server2.URL} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	stats := client.GetStats()
+	if s := stats["account"]; s.Level != 0 || s.CurrentConcurrency != 1 {
+		t.Errorf("expected account pool at level 0 limited to 1, got level %d concurrency %d", s.Level, s.CurrentConcurrency)
+	}
+	if s := stats[server1.URL]; s.Level != 1 || s.CurrentConcurrency != 5 {
+		t.Errorf("expected host pool at level 1 left at 5, got level %d concurrency %d", s.Level, s.CurrentConcurrency)
+	}
+	if _, ok := signals.Load("account"); !ok {
+		t.Error("expected OnSignal to report the account pool")
+	}
+
+	// The account limit applies across both hosts
+	blocked := make(chan struct{})
+	release.Store(blocked)
+
+	var wg sync.WaitGroup
+	for _, u := range []string{server1.URL, server2.URL} {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			resp, err := client.Get(u)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}(u)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for client.GetStats()["account"].Waiting != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s := client.GetStats()["account"]; s.InUse != 1 || s.Waiting != 1 {
+		t.Errorf("expected 1 in use and 1 waiting on the account pool, got %d and %d", s.InUse, s.Waiting)
+	}
+
+	close(blocked)
+	wg.Wait()
+}
+
+func TestClient_KeysFuncBlockedLeaf(t *testing.T) {
+	var limited atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a" && !limited.Swap(true) {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithHTTPStatusHandling().
+		WithConcurrency(1, 1, 1).
+		WithKeysFunc(func(u *url.URL) []string {
+			return []string{"account", capacitor.ExactPathKeyFunc(u)}
+		}, nil).
+		Build()
+
+	resp, err := client.Get(server.URL + "/a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	// A request to the blocked leaf waits without holding the account slot
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	waiting := make(chan struct{})
+	go func() {
+		defer close(waiting)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/a", nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	resp, err = client.Get(server.URL + "/b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected sibling leaf not to wait for the blocked one, took %v", elapsed)
+	}
+
+	cancel()
+	<-waiting
+}
+
+func TestClient_SnapshotFile(t *testing.T) {
+	var limited int64
+	throttled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Capacity-Suggested-Concurrency", "3")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer throttled.Close()
+	exhausted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&limited, 1)
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", "60")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer exhausted.Close()
+
+	path := filepath.Join(t.TempDir(), "capacitor.json")
+	newClient := func() *capacitor.Client {
+		return capacitor.Wrap(nil).
+			WithConcurrency(10, 1, 10).
+			WithCapacityHeaders().
+			WithRateLimitHeaders().
+			WithBlockMode(capacitor.BlockModeFailFast).
+			WithSnapshotFile(path, time.Hour).
+			OnSnapshotError(func(err error) { t.Errorf("snapshot error: %v", err) }).
+			Build()
+	}
+
+	before := newClient()
+	for _, u := range []string{throttled.URL, exhausted.URL} {
+		resp, err := before.Get(u)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if err := before.Close(); err != nil {
+		t.Fatalf("unexpected error closing client: %v", err)
+	}
+
+	after := newClient()
+	defer after.Close()
+
+	if state := after.GetState(throttled.URL); state == nil || state.CurrentConcurrency != 3 {
+		t.Errorf("expected restored concurrency 3, got %+v", state)
+	}
+	if stats := after.GetStats()[throttled.URL]; stats.Available != 3 {
+		t.Errorf("expected restored semaphore capacity 3, got %d available", stats.Available)
+	}
+
+	_, err := after.Get(exhausted.URL)
+	if !capacitor.IsBlockedError(err) {
+		t.Fatalf("expected restored block, got %v", err)
+	}
+	if n := atomic.LoadInt64(&limited); n != 1 {
+		t.Errorf("expected restored block to stop requests, got %d requests", n)
+	}
+}
+
+func TestTransport_SnapshotResources(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("X-RateLimit-Limit", "30")
+		w.Header().Set("X-RateLimit-Reset", "60")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/search/"):
+			w.Header().Set("X-RateLimit-Resource", "search")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+		case strings.HasPrefix(r.URL.Path, "/repos/"):
+			w.Header().Set("X-RateLimit-Resource", "core")
+			w.Header().Set("X-RateLimit-Remaining", "29")
+		default:
+			w.Header().Set("X-RateLimit-Remaining", "10")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	store := capacitor.NewMemoryStore()
+	newClient := func() *capacitor.Client {
+		return capacitor.Wrap(nil).
+			WithRateLimitHeaders().
+			WithBlockMode(capacitor.BlockModeFailFast).
+			WithStateStore(store).
+			Build()
+	}
+
+	before := newClient()
+	for _, path := range []string{"/search/issues", "/repos/syntaqx/capacitor", "/"} {
+		resp, err := before.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	var buf bytes.Buffer
+	if err := before.Transport().SaveSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	after := newClient()
+	if err := after.Transport().LoadSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stats := after.GetStats()[server.URL]
+	if !stats.Resources["search"].BlockedUntil.After(time.Now()) {
+		t.Error("expected search resource block to be restored")
+	}
+	if core := stats.Resources["core"]; core.Remaining != 29 || core.Limit != 30 {
+		t.Errorf("expected core quota 29/30 to be restored, got %d/%d", core.Remaining, core.Limit)
+	}
+
+	// The restored route still maps search requests to the blocked resource
+	if _, err := after.Get(server.URL + "/search/code"); !capacitor.IsBlockedError(err) {
+		t.Errorf("expected search request to be blocked after restore, got %v", err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 3 {
+		t.Errorf("expected no request to reach the blocked resource, got %d requests", n)
+	}
+
+	buf.Reset()
+	if err := after.Transport().SaveSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var snapshot capacitor.Snapshot
+	if err := json.Unmarshal(buf.Bytes(), &snapshot); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reset := snapshot.Hosts[server.URL].QuotaReset; !reset.After(time.Now()) {
+		t.Errorf("expected shared quota reset to be restored, got %v", reset)
+	}
+}
+
+func TestTransport_SnapshotExpiry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Capacity-Suggested-Concurrency", "3")
+		if r.URL.Path == "/limited" {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	newClient := func() *capacitor.Client {
+		return capacitor.Wrap(nil).
+			WithConcurrency(10, 1, 10).
+			WithDefaults().
+			WithStateExpiry(50 * time.Millisecond).
+			Build()
+	}
+
+	before := newClient()
+	resp, err := before.Get(server.URL + "/limited")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := before.Transport().SaveSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	after := newClient()
+	if err := after.Transport().LoadSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The learned limit is stale, but the block window is still active
+	state := after.GetState(server.URL)
+	if state == nil {
+		t.Fatal("expected blocked host to be restored")
+	}
+	if state.CurrentConcurrency != 10 {
+		t.Errorf("expected stale concurrency to be discarded, got %d", state.CurrentConcurrency)
+	}
+	if !state.BlockedUntil.After(time.Now().Add(50 * time.Second)) {
+		t.Errorf("expected block window to be restored, got %v", state.BlockedUntil)
+	}
+}
@@ -31,11 +31,148 @@ type Config struct {
 	// Default: 30s
 	AcquireTimeout time.Duration
 
+	// BlockMode controls how requests behave while a host is blocked
+	// by a Retry-After or an exhausted rate limit.
+	// Default: BlockModeWait
+	BlockMode BlockMode
+
+	// Pacing spreads each host's remaining rate-limit quota evenly across
+	// the time until the quota window resets, instead of spending it as
+	// fast as concurrency allows. Requires rate limit headers.
+	// Default: false
+	Pacing bool
+
+	// PacingBurst is how many requests may be sent ahead of the pace.
+	// Default: 1
+	PacingBurst int
+
+	// ReleaseOnBodyClose holds the concurrency slot until the response
+	// body is fully read, closed, or the request context is done, rather
+	// than releasing it as soon as response headers arrive.
+	// Default: false
+	ReleaseOnBodyClose bool
+
+	// CostFunc returns the number of concurrency slots a request takes on
+	// its host. A cost set on the request context with WithCost takes
+	// precedence. If nil, every request costs 1.
+	CostFunc func(req *http.Request) int
+
+	// MaxTotalConcurrency caps in-flight requests across all hosts, in
+	// addition to each host's limit, to bound file descriptors and egress
+	// when fanning out to many hosts.
+	// Default: 0 (unlimited)
+	MaxTotalConcurrency int
+
+	// MaxQueueLength is the most requests that may wait for a slot on a
+	// host. Further requests fail immediately with a CapacityError with
+	// Op "shed" instead of queueing.
+	// Default: 0 (unlimited)
+	MaxQueueLength int
+
+	// MaxQueueWait is the longest a request may wait for a slot before it
+	// is shed. Unlike AcquireTimeout, it does not include time spent
+	// waiting for a block to expire.
+	// Default: 0 (unlimited)
+	MaxQueueWait time.Duration
+
+	// ShedByDeadline rejects requests up front when their context deadline
+	// (or AcquireTimeout) would pass before a slot is likely to free up,
+	// estimated from the host's queue depth and average latency.
+	// Default: false
+	ShedByDeadline bool
+
+	// SlowStart is how long concurrency takes to ramp back up after a
+	// block (Retry-After, an exhausted rate limit) ends. When a host is
+	// blocked its concurrency drops to MinConcurrency, then rises linearly
+	// to its previous value over SlowStart, so queued requests do not all
+	// fire the moment the block expires.
+	// Default: 0 (disabled)
+	SlowStart time.Duration
+
+	// BlockJitter delays the end of each block by a random amount up to
+	// this duration, so clients blocked by the same signal desynchronize.
+	// Default: 0 (disabled)
+	BlockJitter time.Duration
+
+	// PriorityAging is how long a request waits for a slot before its
+	// priority (see WithPriority) is raised by one level, so low-priority
+	// requests are not starved. Negative disables aging.
+	// Default: 1s
+	PriorityAging time.Duration
+
 	// StateExpiry is how long cached capacity state is considered valid.
 	// After this duration without updates, state is considered stale.
 	// Default: 30s
 	StateExpiry time.Duration
 
+	// BackoffFactor is the multiplier applied to a host's concurrency on a
+	// backoff signal (503, degraded status, GOAWAY) without a suggested
+	// concurrency. Used by the default signal-driven controller.
+	// Default: 0.5
+	BackoffFactor float64
+
+	// BackoffBaseDelay is the block window applied on the second consecutive
+	// backoff signal. It doubles on each further signal, with jitter.
+	// Default: 1s
+	BackoffBaseDelay time.Duration
+
+	// BackoffMaxDelay caps the backoff block window.
+	// Default: 60s
+	BackoffMaxDelay time.Duration
+
+	// BackoffResetAfter is the number of consecutive healthy responses
+	// after which the backoff sequence resets.
+	// Default: 10
+	BackoffResetAfter int
+
+	// Recovery ramps concurrency back toward InitialConcurrency once a
+	// throttled host's state is stale, one step per StateExpiry window.
+	// See LinearRecovery, ExponentialRecovery and ImmediateRecovery.
+	// If nil, concurrency only changes in response to server signals.
+	Recovery RecoveryFunc
+
+	// MaxHosts caps the number of host keys tracked. When a new host
+	// would exceed the cap, the least recently used idle host is evicted.
+	// Hosts with requests in flight, waiting, or blocked are never evicted.
+	// Default: 0 (unlimited)
+	MaxHosts int
+
+	// HostIdleTTL evicts hosts that have not been used or updated for
+	// this long. Idle hosts are swept when new hosts are added.
+	// Default: 0 (never)
+	HostIdleTTL time.Duration
+
+	// OnEvict is called when a host is evicted from the table.
+	OnEvict func(host string, state *State)
+
+	// Retry enables automatic retries of idempotent requests (or requests
+	// with GetBody) that fail with a transport error or an overload status.
+	// Retries wait for the server's Retry-After and any host block.
+	// If nil, requests are not retried.
+	Retry *RetryPolicy
+
+	// RetryBudget limits retries to each host to a fraction of its recent
+	// successful requests. Requests are retries if their context is marked
+	// with WithRetryAttempt (the built-in Retry does this). Over-budget
+	// retries fail with a CapacityError with Op "retry_budget".
+	// If nil, retries are not limited.
+	RetryBudget *RetryBudget
+
+	// CircuitBreaker enables a per-host circuit breaker that fails requests
+	// immediately while a host is returning a stream of errors.
+	// If nil, no circuit breaker is used.
+	CircuitBreaker *CircuitBreaker
+
+	// Hedging sends a second attempt of slow GET and HEAD requests once
+	// they exceed a percentile of the host's recent latency, using the
+	// first response. Hedges only use spare capacity on healthy hosts.
+	// If nil, requests are not hedged.
+	Hedging *Hedging
+
+	// OnRetry is called before each retry attempt.
+	// Can be used for logging or metrics.
+	OnRetry func(host string, attempt *RetryAttempt)
+
 	// OnStateChange is called whenever capacity state changes.
 	// Can be used for logging or metrics.
 	OnStateChange func(host string, state *State)
@@ -44,14 +181,20 @@ type Config struct {
 	// Can be used for logging, metrics, or custom handling.
 	OnSignal func(host string, signal *Signal)
 
+	// Controller creates the ConcurrencyController for each host key.
+	// The controller is fed every request's outcome and decides the limit.
+	// If nil, the limit follows concurrency suggested by server signals.
+	Controller func() ConcurrencyController
+
 	// SignalHandlers is the list of handlers to process responses.
 	// If nil, DefaultSignalHandlers() is used.
 	// Handlers are processed in priority order.
 	SignalHandlers []SignalHandler
 
 	// EnableGOAWAYHandling enables tracking of HTTP/2 GOAWAY frames.
-	// When enabled, GOAWAY frames trigger automatic backoff.
-	// Default: true
+	// When enabled, a GOAWAYHandler is registered so GOAWAY frames and
+	// connection resets trigger automatic backoff.
+	// Default: false
 	EnableGOAWAYHandling bool
 
 	// Transport is the underlying HTTP transport to use.
@@ -65,8 +208,62 @@ type Config struct {
 	//   KeyFunc: capacitor.PathPrefixKeyFunc(1)
 	// If nil, HostKeyFunc is used.
 	KeyFunc func(u *url.URL) string
+
+	// KeysFunc returns the keys of nested concurrency pools a request is
+	// charged to, broadest first, such as an account, a host and an
+	// endpoint. A request takes a slot in every pool, in order, and the
+	// last key is its host key. Keys must be ordered consistently across
+	// requests. Takes precedence over KeyFunc.
+	// If nil, requests are charged to the single KeyFunc pool.
+	KeysFunc func(u *url.URL) []string
+
+	// StateStore shares learned limits, block windows and rate-limit quota
+	// with other clients, such as replicas of the same service, so they
+	// converge on one budget. See MemoryStore and KVStore.
+	// If nil, state is kept only in this client.
+	StateStore StateStore
+
+	// StateSyncInterval is how often each pool's state is refreshed from
+	// the StateStore. Shared quota is drawn from on every request.
+	// Default: 1s
+	StateSyncInterval time.Duration
+
+	// OnStoreError is called when the StateStore fails. Requests continue
+	// using local state.
+	OnStoreError func(key string, err error)
+
+	// SnapshotFile persists learned host state across restarts. State is
+	// loaded from the file when the transport is created, written every
+	// SnapshotInterval, and written again by Close. Entries older than
+	// StateExpiry are discarded on load, except unexpired block windows.
+	// If empty, state is not persisted.
+	SnapshotFile string
+
+	// SnapshotInterval is how often state is written to SnapshotFile.
+	// Default: 1m
+	SnapshotInterval time.Duration
+
+	// OnSnapshotError is called when reading or writing SnapshotFile fails.
+	OnSnapshotError func(err error)
+
+	// SignalLevel returns the index into the KeysFunc keys of the pool a
+	// signal applies to. Out-of-range indexes apply to the last pool.
+	// If nil, signals apply to the last (most specific) pool.
+	SignalLevel func(keys []string, signal *Signal) int
 }
 
+// BlockMode controls how requests behave while a host is blocked.
+type BlockMode int
+
+const (
+	// BlockModeWait waits for the block to expire before sending,
+	// bounded by the request context and AcquireTimeout.
+	BlockModeWait BlockMode = iota
+
+	// BlockModeFailFast fails immediately with a BlockedError.
+	BlockModeFailFast
+)
+
 // DefaultConfig returns the default configuration.
 func DefaultConfig() *Config {
 	return &Config{
@@ -76,6 +273,13 @@ func DefaultConfig() *Config {
 		MinConcurrency:       1,
 		AcquireTimeout:       30 * time.Second,
 		StateExpiry:          30 * time.Second,
+		PriorityAging:        DefaultPriorityAging,
+		StateSyncInterval:    DefaultStateSyncInterval,
+		SnapshotInterval:     DefaultSnapshotInterval,
+		BackoffFactor:        0.5,
+		BackoffBaseDelay:     1 * time.Second,
+		BackoffMaxDelay:      60 * time.Second,
+		BackoffResetAfter:    10,
 		SignalHandlers:       nil, // No handlers = passthrough behavior
 		EnableGOAWAYHandling: false,
 		Transport:            nil,
@@ -106,6 +310,27 @@ func (c *Config) withDefaults() *Config {
 	if cfg.StateExpiry <= 0 {
 		cfg.StateExpiry = 30 * time.Second
 	}
+	if cfg.SnapshotInterval <= 0 {
+		cfg.SnapshotInterval = DefaultSnapshotInterval
+	}
+	if cfg.StateSyncInterval <= 0 {
+		cfg.StateSyncInterval = DefaultStateSyncInterval
+	}
+	if cfg.PriorityAging == 0 {
+		cfg.PriorityAging = DefaultPriorityAging
+	}
+	if cfg.BackoffFactor <= 0 || cfg.BackoffFactor >= 1 {
+		cfg.BackoffFactor = 0.5
+	}
+	if cfg.BackoffBaseDelay <= 0 {
+		cfg.BackoffBaseDelay = 1 * time.Second
+	}
+	if cfg.BackoffMaxDelay <= 0 {
+		cfg.BackoffMaxDelay = 60 * time.Second
+	}
+	if cfg.BackoffResetAfter <= 0 {
+		cfg.BackoffResetAfter = 10
+	}
 	// Don't set default handlers - nil means passthrough
 
 	return &cfg
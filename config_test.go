@@ -31,6 +31,18 @@ func TestDefaultConfig(t *testing.T) {
 	if cfg.StateExpiry != 30*time.Second {
 		t.Errorf("StateExpiry = %v, want %v", cfg.StateExpiry, 30*time.Second)
 	}
+	if cfg.BackoffFactor != 0.5 {
+		t.Errorf("BackoffFactor = %v, want %v", cfg.BackoffFactor, 0.5)
+	}
+	if cfg.BackoffBaseDelay != 1*time.Second {
+		t.Errorf("BackoffBaseDelay = %v, want %v", cfg.BackoffBaseDelay, 1*time.Second)
+	}
+	if cfg.BackoffMaxDelay != 60*time.Second {
+		t.Errorf("BackoffMaxDelay = %v, want %v", cfg.BackoffMaxDelay, 60*time.Second)
+	}
+	if cfg.BackoffResetAfter != 10 {
+		t.Errorf("BackoffResetAfter = %d, want %d", cfg.BackoffResetAfter, 10)
+	}
 	if cfg.SignalHandlers != nil {
 		t.Error("SignalHandlers should be nil")
 	}
@@ -78,6 +90,12 @@ func TestConfig_withDefaults_ZeroValues(t *testing.T) {
 	if result.StateExpiry != 30*time.Second {
 		t.Errorf("StateExpiry = %v, want %v", result.StateExpiry, 30*time.Second)
 	}
+	if result.BackoffFactor != 0.5 {
+		t.Errorf("BackoffFactor = %v, want %v", result.BackoffFactor, 0.5)
+	}
+	if result.BackoffResetAfter != 10 {
+		t.Errorf("BackoffResetAfter = %d, want %d", result.BackoffResetAfter, 10)
+	}
 }
 
 func TestConfig_withDefaults_NegativeValues(t *testing.T) {
@@ -0,0 +1,89 @@
+package capacitor
+
+import "context"
+
+// contextKey is the type for request context values set by this package.
+type contextKey int
+
+const (
+	retryAttemptKey contextKey = iota
+	priorityKey
+	costKey
+	flowKey
+)
+
+// Priority orders requests waiting for a concurrency slot on the same host.
+// Higher priorities are granted slots first. Any integer may be used; the
+// named levels are provided for convenience.
+type Priority int
+
+// Priority levels.
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// WithPriority sets the priority of requests made with ctx. When a host is
+// at its concurrency limit, waiting requests are granted slots highest
+// priority first. Requests without a priority use PriorityNormal.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey, priority)
+}
+
+// PriorityFromContext returns the priority set by WithPriority, or
+// PriorityNormal if none is set.
+func PriorityFromContext(ctx context.Context) Priority {
+	if priority, ok := ctx.Value(priorityKey).(Priority); ok {
+		return priority
+	}
+	return PriorityNormal
+}
+
+// WithRetryAttempt marks a request context as a retry, where attempt is the
+// attempt number (2 for the first retry). Retries are charged against the
+// host's retry budget, if one is configured. Use this when retrying at a
+// layer above the client so capacitor can tell retries from fresh traffic.
+func WithRetryAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, retryAttemptKey, attempt)
+}
+
+// RetryAttemptFromContext returns the attempt number set by WithRetryAttempt,
+// or 1 if the request is not marked as a retry.
+func RetryAttemptFromContext(ctx context.Context) int {
+	if attempt, ok := ctx.Value(retryAttemptKey).(int); ok && attempt > 1 {
+		return attempt
+	}
+	return 1
+}
+
+// WithCost sets the cost of requests made with ctx: the number of
+// concurrency slots each one takes on its host. Use it for requests that
+// are far more expensive than others, such as bulk exports. It takes
+// precedence over Config.CostFunc. Costs below 1 are treated as 1.
+func WithCost(ctx context.Context, cost int) context.Context {
+	return context.WithValue(ctx, costKey, cost)
+}
+
+// CostFromContext returns the cost set by WithCost, or 0 if none is set.
+func CostFromContext(ctx context.Context) int {
+	if cost, ok := ctx.Value(costKey).(int); ok {
+		return cost
+	}
+	return 0
+}
+
+// WithFlow tags requests made with ctx as belonging to a flow, such as a
+// tenant or customer. When a host is at its concurrency limit, waiting
+// requests of the same priority are served fairly across flows, so one
+// busy flow cannot monopolize the host. Requests without a flow share a
+// single default flow.
+func WithFlow(ctx context.Context, flow string) context.Context {
+	return context.WithValue(ctx, flowKey, flow)
+}
+
+// FlowFromContext returns the flow set by WithFlow, or "" if none is set.
+func FlowFromContext(ctx context.Context) string {
+	flow, _ := ctx.Value(flowKey).(string)
+	return flow
+}
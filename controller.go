@@ -0,0 +1,170 @@
+package capacitor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Outcome describes the result of a single request to a host.
+// It is fed to the host's ConcurrencyController after every request.
+type Outcome struct {
+	// StatusCode is the response status, or 0 if the request failed.
+	StatusCode int
+
+	// Err is the transport error, if any.
+	Err error
+
+	// Latency is the time from sending the request to receiving headers.
+	Latency time.Duration
+
+	// Start is when the request was sent.
+	Start time.Time
+
+	// InFlight is the number of requests in flight to the host,
+	// including this one, when the response arrived.
+	InFlight int
+
+	// Action is the aggregated action from any detected signals,
+	// or nil if no signals were detected.
+	Action *SignalAction
+}
+
+// Congested returns true if the outcome indicates the host is overloaded
+// or rate limiting: a 429/420/503, a transport error, or a rate limit,
+// backoff, or block signal.
+func (o Outcome) Congested() bool {
+	if o.Err != nil {
+		// Caller cancellations say nothing about the host
+		return !errors.Is(o.Err, context.Canceled)
+	}
+
+	switch o.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, 420:
+		return true
+	}
+
+	if o.Action != nil {
+		if o.Action.Block || o.Action.Backoff {
+			return true
+		}
+		for _, signal := range o.Action.Signals {
+			if signal.Type == SignalTypeRateLimit {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ConcurrencyController decides the concurrency limit for a single host key.
+// A controller is created per host key, so implementations may keep
+// per-host state. Update calls for a host are serialized.
+type ConcurrencyController interface {
+	// Update is called after every request with the host's current limit
+	// and the request's outcome, and returns the new limit.
+	// The result is clamped to [MinConcurrency, MaxConcurrency].
+	Update(current int, outcome Outcome) int
+}
+
+// LimitEstimator is implemented by controllers that maintain their own
+// estimate of a host's limit. The estimate is reported by GetStats.
+type LimitEstimator interface {
+	EstimatedLimit() float64
+}
+
+// signalController is the default ConcurrencyController.
+// It adopts the concurrency suggested by server signals, reduces the limit
+// by factor on backoff signals without a suggestion, and otherwise leaves
+// the limit unchanged.
+type signalController struct {
+	factor       float64
+	lastDecrease time.Time
+}
+
+func (c *signalController) Update(current int, outcome Outcome) int {
+	a := outcome.Action
+	if a == nil {
+		return current
+	}
+	if a.AdjustConcurrency {
+		return a.NewConcurrency
+	}
+	// Requests sent before the last decrease belong to the same episode
+	if a.Backoff && outcome.Start.After(c.lastDecrease) {
+		c.lastDecrease = time.Now()
+		return int(float64(current) * c.factor)
+	}
+	return current
+}
+
+// ----------------------------------------------------------------------------
+// AIMD Controller
+// ----------------------------------------------------------------------------
+
+// AIMDController is an additive-increase/multiplicative-decrease controller.
+// It probes upward by Increase slots after each window of successful
+// requests (one window = current limit), and multiplies the limit by
+// Decrease when a request is congested. Server-suggested concurrency,
+// when present, caps the limit.
+//
+// Like TCP congestion control, the limit is only raised while it is
+// actually being used, and it is decreased at most once per round trip.
+type AIMDController struct {
+	// Increase is the number of slots added per window of successes.
+	// Default: 1
+	Increase int
+
+	// Decrease is the factor applied to the limit on congestion.
+	// Default: 0.5
+	Decrease float64
+
+	mu           sync.Mutex
+	successes    int
+	lastDecrease time.Time
+}
+
+// NewAIMDController creates an AIMD controller.
+// Zero or invalid values use the defaults.
+func NewAIMDController(increase int, decrease float64) *AIMDController {
+	if increase <= 0 {
+		increase = 1
+	}
+	if decrease <= 0 || decrease >= 1 {
+		decrease = 0.5
+	}
+	return &AIMDController{
+		Increase: increase,
+		Decrease: decrease,
+	}
+}
+
+func (c *AIMDController) Update(current int, outcome Outcome) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next := current
+
+	if outcome.Congested() {
+		// Requests sent before the last decrease were already accounted for
+		if outcome.Start.After(c.lastDecrease) {
+			next = int(float64(current) * c.Decrease)
+			c.lastDecrease = time.Now()
+			c.successes = 0
+		}
+	} else if outcome.InFlight*2 >= current {
+		c.successes++
+		if c.successes >= current {
+			next = current + c.Increase
+			c.successes = 0
+		}
+	}
+
+	if a := outcome.Action; a != nil && a.AdjustConcurrency && a.NewConcurrency > 0 && next > a.NewConcurrency {
+		next = a.NewConcurrency
+	}
+
+	return next
+}
@@ -0,0 +1,216 @@
+package capacitor_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/syntaqx/capacitor"
+)
+
+func TestAIMDController_AdditiveIncrease(t *testing.T) {
+	c := capacitor.NewAIMDController(1, 0.5)
+
+	limit := 4
+	for i := 0; i < 4; i++ {
+		limit = c.Update(limit, capacitor.Outcome{
+			StatusCode: http.StatusOK,
+			Start:      time.Now(),
+			InFlight:   4,
+		})
+	}
+	if limit != 5 {
+		t.Errorf("expected limit 5 after one window of successes, got %d", limit)
+	}
+}
+
+func TestAIMDController_NoIncreaseWhenUnderused(t *testing.T) {
+	c := capacitor.NewAIMDController(1, 0.5)
+
+	limit := 10
+	for i := 0; i < 50; i++ {
+		limit = c.Update(limit, capacitor.Outcome{
+			StatusCode: http.StatusOK,
+			Start:      time.Now(),
+			InFlight:   1,
+		})
+	}
+	if limit != 10 {
+		t.Errorf("expected limit unchanged while underused, got %d", limit)
+	}
+}
+
+func TestAIMDController_MultiplicativeDecrease(t *testing.T) {
+	c := capacitor.NewAIMDController(1, 0.5)
+
+	start := time.Now()
+	limit := c.Update(16, capacitor.Outcome{
+		StatusCode: http.StatusTooManyRequests,
+		Start:      start,
+	})
+	if limit != 8 {
+		t.Errorf("expected limit 8 after congestion, got %d", limit)
+	}
+
+	// A request sent before the decrease must not decrease again
+	limit = c.Update(limit, capacitor.Outcome{
+		Err:   errors.New("connection reset"),
+		Start: start,
+	})
+	if limit != 8 {
+		t.Errorf("expected one decrease per round trip, got %d", limit)
+	}
+
+	limit = c.Update(limit, capacitor.Outcome{
+		StatusCode: http.StatusServiceUnavailable,
+		Start:      time.Now(),
+	})
+	if limit != 4 {
+		t.Errorf("expected limit 4 after second congestion, got %d", limit)
+	}
+}
+
+func TestAIMDController_SuggestionCaps(t *testing.T) {
+	c := capacitor.NewAIMDController(1, 0.5)
+
+	limit := c.Update(20, capacitor.Outcome{
+		StatusCode: http.StatusOK,
+		Start:      time.Now(),
+		InFlight:   20,
+		Action: &capacitor.SignalAction{
+			AdjustConcurrency: true,
+			NewConcurrency:    5,
+		},
+	})
+	if limit != 5 {
+		t.Errorf("expected limit capped at suggestion 5, got %d", limit)
+	}
+}
+
+func TestClient_AIMD(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithConcurrency(8, 1, 16).
+		WithAIMD(1, 0.5).
+		Build()
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if state := client.GetState(server.URL); state.CurrentConcurrency != 4 {
+		t.Errorf("expected concurrency halved to 4, got %d", state.CurrentConcurrency)
+	}
+}
+
+func TestGradientController_GrowsAtBaseline(t *testing.T) {
+	c := capacitor.NewGradientController()
+
+	limit := 10
+	for i := 0; i < 20; i++ {
+		limit = c.Update(limit, capacitor.Outcome{
+			StatusCode: http.StatusOK,
+			Latency:    10 * time.Millisecond,
+			Start:      time.Now(),
+			InFlight:   limit,
+		})
+	}
+	if limit <= 10 {
+		t.Errorf("expected limit to grow while latency is at baseline, got %d", limit)
+	}
+}
+
+func TestGradientController_ShrinksOnQueueing(t *testing.T) {
+	c := capacitor.NewGradientController()
+
+	limit := 50
+	limit = c.Update(limit, capacitor.Outcome{
+		StatusCode: http.StatusOK,
+		Latency:    10 * time.Millisecond,
+		Start:      time.Now(),
+		InFlight:   limit,
+	})
+	for i := 0; i < 30; i++ {
+		limit = c.Update(limit, capacitor.Outcome{
+			StatusCode: http.StatusOK,
+			Latency:    100 * time.Millisecond,
+			Start:      time.Now(),
+			InFlight:   limit,
+		})
+	}
+	if limit >= 50 {
+		t.Errorf("expected limit to shrink as latency rises, got %d", limit)
+	}
+	if est := c.EstimatedLimit(); int(est) != limit {
+		t.Errorf("expected estimate %v to match limit %d", est, limit)
+	}
+}
+
+func TestGradientController_OneDecreasePerEpisode(t *testing.T) {
+	c := capacitor.NewGradientController()
+
+	// A burst of requests sent together all come back throttled
+	start := time.Now()
+	limit := 64
+	for i := 0; i < 10; i++ {
+		limit = c.Update(limit, capacitor.Outcome{
+			StatusCode: http.StatusTooManyRequests,
+			Start:      start,
+		})
+	}
+	if limit != 32 {
+		t.Errorf("expected one halving to 32 for the burst, got %d", limit)
+	}
+
+	limit = c.Update(limit, capacitor.Outcome{
+		StatusCode: http.StatusTooManyRequests,
+		Start:      time.Now(),
+	})
+	if limit != 16 {
+		t.Errorf("expected limit 16 after a later congestion, got %d", limit)
+	}
+}
+
+func TestClient_GradientStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := capacitor.Wrap(nil).
+		WithConcurrency(1, 1, 16).
+		WithGradient().
+		Build()
+
+	for i := 0; i < 10; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	stats := client.GetStats()[server.URL]
+	if stats.EstimatedLimit < 1 {
+		t.Errorf("expected estimated limit in stats, got %v", stats.EstimatedLimit)
+	}
+	if stats.CurrentConcurrency <= 1 {
+		t.Errorf("expected concurrency to grow from 1, got %d", stats.CurrentConcurrency)
+	}
+}
@@ -1,7 +1,9 @@
 package capacitor
 
 import (
+	"errors"
 	"fmt"
+	"time"
 )
 
 // CapacityError represents an error related to capacity limiting.
@@ -29,3 +31,24 @@ func IsCapacityError(err error) bool {
 	_, ok := err.(*CapacityError)
 	return ok
 }
+
+// BlockedError indicates that a host is blocked by a server signal
+// (e.g., Retry-After or an exhausted rate limit) and the request was not sent.
+type BlockedError struct {
+	Until time.Time // when the block expires
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("blocked until %s", e.Until.Format(time.RFC3339))
+}
+
+// RetryAfter returns how long until the block expires.
+func (e *BlockedError) RetryAfter() time.Duration {
+	return time.Until(e.Until)
+}
+
+// IsBlockedError returns true if the error was caused by a blocked host.
+func IsBlockedError(err error) bool {
+	var blocked *BlockedError
+	return errors.As(err, &blocked)
+}
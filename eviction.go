@@ -0,0 +1,108 @@
+package capacitor
+
+import (
+	"container/list"
+	"time"
+)
+
+// evictedHost records a host removed from the table, for OnEvict.
+type evictedHost struct {
+	host  string
+	state *State
+}
+
+// idle returns true if the host has no requests in flight or waiting,
+// is not blocked, and has not been used or updated within ttl.
+func (hs *hostState) idle(now time.Time, ttl time.Duration) bool {
+	if hs.refs.Load() > 0 || hs.semaphore.InUse() > 0 || hs.semaphore.Waiting() > 0 {
+		return false
+	}
+	if hs.state.IsBlocked() || hs.resourcesBlocked(now) {
+		return false
+	}
+
+	last := time.Unix(0, hs.lastUsed.Load())
+	if updated := hs.state.GetLastUpdated(); updated.After(last) {
+		last = updated
+	}
+	return now.Sub(last) >= ttl
+}
+
+// evictLocked removes hosts idle for longer than HostIdleTTL, then removes
+// least recently used idle hosts until there is room for one more under
+// MaxHosts. Hosts with requests in flight or waiting are never evicted,
+// so the table may temporarily exceed MaxHosts. The caller must hold t.mu.
+//
+// Candidates are taken from the tail of the recency list, so eviction only
+// looks at the least recently used hosts rather than the whole table.
+// Eviction runs when a new host is added, which is the only way the table
+// grows, so no background goroutine is needed.
+func (t *Transport) evictLocked(now time.Time) []evictedHost {
+	if t.lru == nil {
+		return nil
+	}
+
+	t.lruMu.Lock()
+	defer t.lruMu.Unlock()
+
+	var evicted []evictedHost
+
+	if ttl := t.config.HostIdleTTL; ttl > 0 && now.Sub(t.lastSweep) >= ttl/2 {
+		t.lastSweep = now
+		for e := t.lru.Back(); e != nil; {
+			prev := e.Prev()
+			hs := e.Value.(*hostState)
+			if now.Sub(time.Unix(0, hs.lastUsed.Load())) < ttl {
+				break // every host ahead was used more recently
+			}
+			if hs.idle(now, ttl) {
+				evicted = append(evicted, t.evictElemLocked(e))
+			}
+			e = prev
+		}
+	}
+
+	if t.config.MaxHosts > 0 {
+		for e := t.lru.Back(); e != nil && len(t.hosts) >= t.config.MaxHosts; {
+			prev := e.Prev()
+			if e.Value.(*hostState).idle(now, 0) {
+				evicted = append(evicted, t.evictElemLocked(e))
+			}
+			e = prev
+		}
+	}
+
+	return evicted
+}
+
+// evictElemLocked removes the host at e from the table and the recency
+// list. The caller must hold t.mu and t.lruMu.
+func (t *Transport) evictElemLocked(e *list.Element) evictedHost {
+	hs := e.Value.(*hostState)
+	t.lru.Remove(e)
+	hs.lruElem = nil
+	delete(t.hosts, hs.key)
+	return evictedHost{hs.key, hs.state.Clone()}
+}
+
+// touch moves a host to the front of the recency list.
+func (t *Transport) touch(hs *hostState) {
+	if t.lru == nil {
+		return
+	}
+	t.lruMu.Lock()
+	if hs.lruElem != nil {
+		t.lru.MoveToFront(hs.lruElem)
+	}
+	t.lruMu.Unlock()
+}
+
+// notifyEvicted calls OnEvict for each evicted host.
+func (t *Transport) notifyEvicted(evicted []evictedHost) {
+	if t.config.OnEvict == nil {
+		return
+	}
+	for _, e := range evicted {
+		t.config.OnEvict(e.host, e.state)
+	}
+}
@@ -0,0 +1,64 @@
+package capacitor
+
+import "context"
+
+// AggregateStats summarizes all hosts, including the client-wide
+// concurrency limit if one is configured.
+type AggregateStats struct {
+	// Hosts is the number of host keys tracked.
+	Hosts int
+
+	// InUse and Waiting are summed across all hosts.
+	InUse   int
+	Waiting int
+
+	// Limit is the client-wide concurrency limit, or 0 if unlimited.
+	// GlobalInUse is the number of requests holding a client-wide slot
+	// and GlobalWaiting the number waiting for one.
+	Limit         int
+	GlobalInUse   int
+	GlobalWaiting int
+}
+
+// acquireGlobal takes a client-wide slot, if a MaxTotalConcurrency is set.
+// It is always taken after the host slot, so the two cannot deadlock.
+func (t *Transport) acquireGlobal(ctx context.Context, host string, hs *hostState) error {
+	if t.global == nil {
+		return nil
+	}
+	if err := t.global.Acquire(ctx); err != nil {
+		return &CapacityError{
+			Op:    "acquire_global",
+			Host:  host,
+			Err:   err,
+			State: hs.state.Clone(),
+		}
+	}
+	return nil
+}
+
+// releaseGlobal returns a client-wide slot.
+func (t *Transport) releaseGlobal() {
+	if t.global != nil {
+		t.global.Release()
+	}
+}
+
+// GetAggregateStats returns statistics summed across all hosts, along with
+// the client-wide concurrency limit's usage.
+func (t *Transport) GetAggregateStats() AggregateStats {
+	t.mu.RLock()
+	stats := AggregateStats{Hosts: len(t.hosts)}
+	for _, hs := range t.hosts {
+		stats.InUse += hs.semaphore.InUse()
+		stats.Waiting += hs.semaphore.Waiting()
+	}
+	t.mu.RUnlock()
+
+	if t.global != nil {
+		stats.Limit = t.global.Capacity()
+		stats.GlobalInUse = t.global.InUse()
+		stats.GlobalWaiting = t.global.Waiting()
+	}
+	return stats
+}
@@ -0,0 +1,119 @@
+package capacitor
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// GradientController is a latency-based ConcurrencyController for hosts
+// that send no capacity headers, in the spirit of TCP Vegas and gradient
+// limiters. It tracks a no-load baseline round-trip time and a smoothed
+// recent round-trip time per host key. While latency stays near the
+// baseline the limit grows; as queueing delay appears the ratio
+// baseline/latency falls below one and the limit shrinks.
+//
+// Each update computes:
+//
+//	gradient = clamp(Tolerance * baseline / latency, 0.5, 1)
+//	limit    = limit*gradient + sqrt(limit)
+//
+// smoothed by Smoothing. The estimate is reported through Stats.EstimatedLimit.
+type GradientController struct {
+	// Tolerance is how far latency may exceed the baseline before the
+	// limit shrinks (1.5 allows 50% queueing delay).
+	// Default: 1.5
+	Tolerance float64
+
+	// Smoothing weights each new estimate against the previous one.
+	// Default: 0.2
+	Smoothing float64
+
+	// BaselineWindow is how often the baseline is reset to the recent
+	// latency, so it can follow the host if its unloaded latency drifts.
+	// Default: 5m
+	BaselineWindow time.Duration
+
+	mu         sync.Mutex
+	estimate   float64
+	latency    float64 // smoothed recent latency, in nanoseconds
+	baseline   float64 // minimum observed latency, in nanoseconds
+	baselineAt time.Time
+
+	lastDecrease time.Time
+}
+
+// NewGradientController creates a gradient controller with default settings.
+func NewGradientController() *GradientController {
+	return &GradientController{
+		Tolerance:      1.5,
+		Smoothing:      0.2,
+		BaselineWindow: 5 * time.Minute,
+	}
+}
+
+func (c *GradientController) Update(current int, outcome Outcome) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Re-anchor if the limit was changed outside the controller
+	// (clamping, recovery, or a server suggestion)
+	if c.estimate == 0 || int(c.estimate) != current {
+		c.estimate = float64(current)
+	}
+
+	if outcome.Congested() {
+		// Requests sent before the last decrease were already accounted for
+		if outcome.Start.After(c.lastDecrease) {
+			c.estimate = math.Max(1, c.estimate/2)
+			c.lastDecrease = time.Now()
+		}
+		return c.limit(outcome)
+	}
+
+	if outcome.Latency <= 0 {
+		return c.limit(outcome)
+	}
+
+	sample := float64(outcome.Latency)
+	if c.latency == 0 {
+		c.latency = sample
+	} else {
+		c.latency = 0.8*c.latency + 0.2*sample
+	}
+
+	now := time.Now()
+	if c.baseline == 0 || sample < c.baseline {
+		c.baseline = sample
+		c.baselineAt = now
+	} else if c.BaselineWindow > 0 && now.Sub(c.baselineAt) > c.BaselineWindow {
+		c.baseline = c.latency
+		c.baselineAt = now
+	}
+
+	// Latency under light load says nothing about the limit
+	if outcome.InFlight*2 < current {
+		return c.limit(outcome)
+	}
+
+	gradient := math.Max(0.5, math.Min(1, c.Tolerance*c.baseline/c.latency))
+	next := c.estimate*gradient + math.Sqrt(c.estimate)
+	c.estimate = (1-c.Smoothing)*c.estimate + c.Smoothing*next
+
+	return c.limit(outcome)
+}
+
+// limit returns the current estimate, capped by any server suggestion.
+func (c *GradientController) limit(outcome Outcome) int {
+	if a := outcome.Action; a != nil && a.AdjustConcurrency && a.NewConcurrency > 0 && c.estimate > float64(a.NewConcurrency) {
+		c.estimate = float64(a.NewConcurrency)
+	}
+	return int(c.estimate)
+}
+
+// EstimatedLimit returns the controller's current limit estimate.
+func (c *GradientController) EstimatedLimit() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.estimate
+}
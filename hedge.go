@@ -0,0 +1,245 @@
+package capacitor
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hedging configures hedged requests. If a GET or HEAD has not received a
+// response after the host's Percentile latency, a second attempt is sent
+// and whichever responds first is used; the other is cancelled.
+//
+// A hedge is only sent when the host's semaphore has a spare slot and the
+// host is healthy: not blocked, its circuit breaker (if any) is closed,
+// and its reported Status is healthy. Hosts that report no status are
+// treated as healthy. This keeps hedging from amplifying overload.
+type Hedging struct {
+	// Percentile of observed latency after which a hedge is sent.
+	// Default: 0.95
+	Percentile float64
+
+	// MinSamples is the number of latency samples required before hedging.
+	// Default: 20
+	MinSamples int
+
+	// MinDelay is the shortest delay before a hedge is sent.
+	// Default: 0
+	MinDelay time.Duration
+}
+
+// withDefaults returns a copy of the hedging config with defaults applied.
+func (h Hedging) withDefaults() Hedging {
+	if h.Percentile <= 0 || h.Percentile >= 1 {
+		h.Percentile = 0.95
+	}
+	if h.MinSamples <= 0 {
+		h.MinSamples = 20
+	}
+	return h
+}
+
+// latencySamples is the number of recent latencies kept per host.
+const latencySamples = 128
+
+// latencyWindow keeps a ring of recent request latencies for a host.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	count   int
+	next    int
+}
+
+// add records a latency sample.
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencySamples
+	if w.count < latencySamples {
+		w.count++
+	}
+}
+
+// percentile returns the p-th percentile latency and the number of samples.
+func (w *latencyWindow) percentile(p float64) (time.Duration, int) {
+	w.mu.Lock()
+	sorted := make([]time.Duration, w.count)
+	copy(sorted, w.samples[:w.count])
+	w.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0, 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))], len(sorted)
+}
+
+// hedgeResult is the result of one attempt of a hedged request.
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+}
+
+// cancelBody cancels the winning attempt's context once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// send sends the request through the base transport, hedging it if enabled.
+// The caller holds cost slots on hs.semaphore (and each parent pool) for
+// the request; a hedge takes as many again, which are released when the
+// losing attempt finishes.
+func (t *Transport) send(req *http.Request, hs *hostState, parents []level, cost int) (*http.Response, error) {
+	if hs.latencies == nil || !hedgeable(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	delay, ok := t.hedgeDelay(hs)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	attempt := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		r := req.Clone(ctx)
+		n := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := t.base.RoundTrip(r)
+			results <- hedgeResult{attempt: n, resp: resp, err: err}
+		}()
+	}
+
+	attempt()
+
+	timer := time.NewTimer(delay)
+	select {
+	case res := <-results:
+		timer.Stop()
+		return finishHedge(res, cancels[res.attempt])
+	case <-timer.C:
+		if t.canHedge(hs) && t.tryAcquireHedge(hs, parents, cost) {
+			hs.hedges.Add(1)
+			attempt()
+		}
+	}
+
+	res := <-results
+	if len(cancels) == 1 {
+		return finishHedge(res, cancels[0])
+	}
+
+	// Prefer a response over an error if the other attempt is still running
+	if res.err != nil {
+		other := <-results
+		t.releaseHedge(hs, parents, cost)
+		if other.err == nil {
+			cancels[res.attempt]()
+			return finishHedge(other, cancels[other.attempt])
+		}
+		cancels[other.attempt]()
+		return finishHedge(res, cancels[res.attempt])
+	}
+
+	// Cancel the loser and release its slot once it finishes
+	loser := cancels[1-res.attempt]
+	loser()
+	go func() {
+		if other := <-results; other.resp != nil {
+			other.resp.Body.Close()
+		}
+		t.releaseHedge(hs, parents, cost)
+	}()
+
+	return finishHedge(res, cancels[res.attempt])
+}
+
+// finishHedge returns an attempt's result, tying its context to its body.
+func finishHedge(res hedgeResult, cancel context.CancelFunc) (*http.Response, error) {
+	if res.err != nil {
+		cancel()
+		return nil, res.err
+	}
+	res.resp.Body = &cancelBody{ReadCloser: res.resp.Body, cancel: cancel}
+	return res.resp, nil
+}
+
+// hedgeable returns true for requests that may be hedged: GET or HEAD
+// without a body.
+func hedgeable(req *http.Request) bool {
+	if req.Method != "" && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// hedgeDelay returns how long to wait before hedging, or false if there
+// are not yet enough latency samples.
+func (t *Transport) hedgeDelay(hs *hostState) (time.Duration, bool) {
+	h := t.config.Hedging.withDefaults()
+	delay, n := hs.latencies.percentile(h.Percentile)
+	if n < h.MinSamples {
+		return 0, false
+	}
+	if delay < h.MinDelay {
+		delay = h.MinDelay
+	}
+	return delay, true
+}
+
+// canHedge returns true if the host is healthy enough to receive a hedge.
+func (t *Transport) canHedge(hs *hostState) bool {
+	if hs.state.IsBlocked() {
+		return false
+	}
+	if hs.breaker != nil && hs.breaker.current() != BreakerClosed {
+		return false
+	}
+	hs.state.mu.RLock()
+	status := hs.state.Status
+	hs.state.mu.RUnlock()
+	return status == StatusUnknown || status.IsHealthy()
+}
+
+// tryAcquireHedge takes the slots for a hedge without waiting: cost slots
+// on each parent pool and the host, and a client-wide slot if
+// MaxTotalConcurrency is set.
+func (t *Transport) tryAcquireHedge(hs *hostState, parents []level, cost int) bool {
+	for i, l := range parents {
+		if !l.hs.semaphore.TryAcquireN(cost) {
+			releaseLevelSlots(parents[:i], cost)
+			return false
+		}
+	}
+	if !hs.semaphore.TryAcquireN(cost) {
+		releaseLevelSlots(parents, cost)
+		return false
+	}
+	if t.global != nil && !t.global.TryAcquire() {
+		hs.semaphore.ReleaseN(cost)
+		releaseLevelSlots(parents, cost)
+		return false
+	}
+	return true
+}
+
+// releaseHedge returns the slots taken by tryAcquireHedge.
+func (t *Transport) releaseHedge(hs *hostState, parents []level, cost int) {
+	hs.semaphore.ReleaseN(cost)
+	releaseLevelSlots(parents, cost)
+	t.releaseGlobal()
+}
@@ -0,0 +1,156 @@
+package capacitor
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// KV is the minimal key/value protocol used by KVStore. It maps directly
+// onto stores such as Redis (GET, SET with EX/PX, DECRBY) or Memcached.
+type KV interface {
+	// Get returns the value for key, or nil if the key does not exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set stores value under key, expiring after ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// DecrBy atomically decrements the integer stored under key by n and
+	// returns the new value.
+	DecrBy(ctx context.Context, key string, n int64) (int64, error)
+}
+
+// KVStore is a StateStore over a shared key/value store, so clients in
+// different processes converge on the same limits and rate-limit budget.
+//
+// Each pool's state is stored as JSON under Prefix+key, and its remaining
+// quota as a decimal counter under Prefix+key+":quota" so it can be
+// decremented atomically. Saves read and then write the state, so
+// concurrent saves may overwrite each other's concurrency; every response
+// carrying signals saves again, so the store converges.
+type KVStore struct {
+	KV KV
+
+	// Prefix namespaces the keys in the store.
+	Prefix string
+
+	// TTL is how long state is kept after its last save, extended to cover
+	// any block or quota window.
+	// Default: 5m
+	TTL time.Duration
+}
+
+// NewKVStore creates a StateStore over kv, namespacing keys with prefix.
+func NewKVStore(kv KV, prefix string) *KVStore {
+	return &KVStore{KV: kv, Prefix: prefix, TTL: 5 * time.Minute}
+}
+
+// Load implements StateStore.
+func (s *KVStore) Load(ctx context.Context, key string) (*SharedState, error) {
+	data, err := s.KV.Get(ctx, s.Prefix+key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var state SharedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	// The counter is authoritative for the remaining quota
+	if state.hasQuota(time.Now()) {
+		data, err := s.KV.Get(ctx, s.quotaKey(key))
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			if remaining, err := strconv.Atoi(string(data)); err == nil {
+				state.Remaining = remaining
+			}
+		}
+	}
+	return &state, nil
+}
+
+// Save implements StateStore.
+func (s *KVStore) Save(ctx context.Context, key string, update *SharedState) error {
+	state, err := s.Load(ctx, key)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &SharedState{}
+	}
+	state.merge(update)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	ttl := s.ttl()
+	if d := state.BlockedUntil.Sub(now); d > ttl {
+		ttl = d
+	}
+	if d := state.Reset.Sub(now); d > ttl {
+		ttl = d
+	}
+	if err := s.KV.Set(ctx, s.Prefix+key, data, ttl); err != nil {
+		return err
+	}
+
+	// A quota reported by the server replaces the counter until it resets
+	if update.hasQuota(now) {
+		value := []byte(strconv.Itoa(update.Remaining))
+		return s.KV.Set(ctx, s.quotaKey(key), value, update.Reset.Sub(now))
+	}
+	return nil
+}
+
+// TakeQuota implements StateStore. Only an existing counter is
+// decremented, since DecrBy on a missing key would create one that never
+// expires.
+func (s *KVStore) TakeQuota(ctx context.Context, key string, n int) (int, error) {
+	data, err := s.KV.Get(ctx, s.quotaKey(key))
+	if err != nil {
+		return 0, err
+	}
+	if data == nil {
+		return 0, ErrNoQuota
+	}
+
+	remaining, err := s.KV.DecrBy(ctx, s.quotaKey(key), int64(n))
+	if err != nil || remaining >= 0 {
+		return int(remaining), err
+	}
+
+	// The counter may have expired between Get and DecrBy and been
+	// recreated without a TTL; give it the window's TTL again
+	state, err := s.Load(ctx, key)
+	if err != nil {
+		return int(remaining), err
+	}
+	now := time.Now()
+	value := []byte(strconv.FormatInt(remaining, 10))
+	if state == nil || !state.hasQuota(now) {
+		// The window is over; let the stray counter expire promptly
+		if err := s.KV.Set(ctx, s.quotaKey(key), value, time.Second); err != nil {
+			return 0, err
+		}
+		return 0, ErrNoQuota
+	}
+	return int(remaining), s.KV.Set(ctx, s.quotaKey(key), value, state.Reset.Sub(now))
+}
+
+func (s *KVStore) quotaKey(key string) string {
+	return s.Prefix + key + ":quota"
+}
+
+func (s *KVStore) ttl() time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return 5 * time.Minute
+}
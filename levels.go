@@ -0,0 +1,108 @@
+package capacitor
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// level is one of the concurrency pools a request is charged to.
+type level struct {
+	key string
+	hs  *hostState
+}
+
+// poolKeys returns the keys of the pools a request is charged to, broadest
+// first. The last key is the request's own host key.
+func (t *Transport) poolKeys(u *url.URL) []string {
+	if t.config.KeysFunc != nil {
+		if keys := t.config.KeysFunc(u); len(keys) > 0 {
+			return keys
+		}
+	}
+	if t.config.KeyFunc != nil {
+		return []string{t.config.KeyFunc(u)}
+	}
+	return []string{HostKeyFunc(u)}
+}
+
+// parentLevels returns the pools for all but the last key, referenced until
+// releaseLevels is called.
+func (t *Transport) parentLevels(keys []string) []level {
+	if len(keys) < 2 {
+		return nil
+	}
+	parents := make([]level, len(keys)-1)
+	for i, key := range keys[:len(keys)-1] {
+		parents[i] = level{key: key, hs: t.getOrCreateHostState(key, i)}
+	}
+	return parents
+}
+
+// releaseLevels releases the references taken by parentLevels.
+func releaseLevels(levels []level) {
+	for _, l := range levels {
+		l.hs.releaseRef()
+	}
+}
+
+// prepareLevels ramps up each parent pool's concurrency if due and waits
+// for its pacer, broadest first, before any slot is taken. Slots are then
+// taken by acquire, in the same order for every request, so requests
+// sharing pools cannot deadlock.
+func (t *Transport) prepareLevels(ctx context.Context, levels []level) error {
+	for _, l := range levels {
+		t.recoverConcurrency(l.key, l.hs)
+		t.slowStart(l.key, l.hs)
+		if err := t.pace(ctx, l.key, l.hs, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// levelsBlocked returns true if the host, its rate-limit resource pool or
+// any parent pool is blocked at now.
+func levelsBlocked(hs *hostState, pool *resourcePool, parents []level, now time.Time) bool {
+	if now.Before(blockedUntil(hs, pool)) {
+		return true
+	}
+	for _, l := range parents {
+		if now.Before(l.hs.state.GetBlockedUntil()) {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseLevelSlots releases cost slots on each pool.
+func releaseLevelSlots(levels []level, cost int) {
+	for _, l := range levels {
+		l.hs.semaphore.ReleaseN(cost)
+	}
+}
+
+// slowStartLevels advances the slow start of each pool after a release.
+func (t *Transport) slowStartLevels(levels []level) {
+	for _, l := range levels {
+		t.slowStart(l.key, l.hs)
+	}
+}
+
+// routeSignals splits signals by the index of the pool they apply to, as
+// decided by SignalLevel. With a single pool, every signal applies to it.
+func (t *Transport) routeSignals(keys []string, signals []*Signal) [][]*Signal {
+	routed := make([][]*Signal, len(keys))
+	last := len(keys) - 1
+	for _, signal := range signals {
+		i := last
+		if t.config.SignalLevel != nil && last > 0 {
+			i = t.config.SignalLevel(keys, signal)
+			if i < 0 || i > last {
+				i = last
+			}
+		}
+		routed[i] = append(routed[i], signal)
+	}
+	return routed
+}
@@ -0,0 +1,120 @@
+package capacitor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pacer spreads a host's remaining rate-limit quota evenly across the time
+// until the quota window resets. It is a token bucket expressed as a
+// theoretical arrival time: each request reserves the next send time one
+// interval after the previous one, with up to burst requests sent early.
+type pacer struct {
+	mu       sync.Mutex
+	burst    int
+	interval time.Duration // time between requests, 0 if not pacing
+	resetAt  time.Time     // when the quota window resets
+	tat      time.Time     // theoretical arrival time of the next request
+}
+
+func newPacer(burst int) *pacer {
+	if burst < 1 {
+		burst = 1
+	}
+	return &pacer{burst: burst}
+}
+
+// update sets the pace from the remaining quota and window reset time.
+func (p *pacer) update(remaining int, resetAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	window := time.Until(resetAt)
+	if remaining <= 0 || window <= 0 {
+		p.interval = 0
+		return
+	}
+	p.interval = window / time.Duration(remaining)
+	p.resetAt = resetAt
+}
+
+// reserve reserves the next send slot and returns how long to wait for it.
+func (p *pacer) reserve(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Once the window resets the quota is replenished, so stop pacing
+	// until a response reports the new window
+	if p.interval == 0 || !now.Before(p.resetAt) {
+		p.interval = 0
+		return 0
+	}
+
+	tat := p.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	p.tat = tat.Add(p.interval)
+
+	delay := tat.Sub(now) - time.Duration(p.burst-1)*p.interval
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// currentInterval returns the time between requests, or 0 if not pacing.
+func (p *pacer) currentInterval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !time.Now().Before(p.resetAt) {
+		return 0
+	}
+	return p.interval
+}
+
+// updatePacer sets the pace from any rate-limit quota reported in signals.
+func updatePacer(p *pacer, signals []*Signal) {
+	if p == nil {
+		return
+	}
+	for _, signal := range signals {
+		_, ok := signal.Raw["Remaining"]
+		if (ok || len(signal.Quotas) > 0) && !signal.BlockUntil.IsZero() {
+			p.update(signal.Remaining, signal.BlockUntil)
+		}
+	}
+}
+
+// pace waits for the next paced send time, if pacing is enabled.
+// Requests charged to a rate-limit resource follow that resource's pace.
+func (t *Transport) pace(ctx context.Context, host string, hs *hostState, pool *resourcePool) error {
+	p := hs.pacer
+	if pool != nil {
+		p = pool.pacer
+	}
+	if p == nil {
+		return nil
+	}
+
+	delay := p.reserve(time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return &CapacityError{
+			Op:    "pace",
+			Host:  host,
+			Err:   ctx.Err(),
+			State: hs.state.Clone(),
+		}
+	case <-timer.C:
+		return nil
+	}
+}
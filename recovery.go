@@ -0,0 +1,83 @@
+package capacitor
+
+import "math"
+
+// RecoveryFunc returns the next concurrency limit when recovering from
+// current toward target after a host's state has gone stale.
+// Results are clamped so each step makes progress without passing target.
+type RecoveryFunc func(current, target int) int
+
+// LinearRecovery returns a RecoveryFunc that adds step slots per
+// StateExpiry window.
+func LinearRecovery(step int) RecoveryFunc {
+	if step < 1 {
+		step = 1
+	}
+	return func(current, target int) int {
+		return current + step
+	}
+}
+
+// ExponentialRecovery returns a RecoveryFunc that multiplies the limit by
+// factor per StateExpiry window, similar to TCP slow start.
+func ExponentialRecovery(factor float64) RecoveryFunc {
+	if factor <= 1 {
+		factor = 2
+	}
+	return func(current, target int) int {
+		return int(math.Ceil(float64(current) * factor))
+	}
+}
+
+// ImmediateRecovery is a RecoveryFunc that restores the target in one step.
+func ImmediateRecovery(current, target int) int {
+	return target
+}
+
+// recoveryTarget returns the concurrency limit that recovery ramps toward.
+func (t *Transport) recoveryTarget() int {
+	target := t.config.InitialConcurrency
+	if target > t.config.MaxConcurrency {
+		target = t.config.MaxConcurrency
+	}
+	if target < t.config.MinConcurrency {
+		target = t.config.MinConcurrency
+	}
+	return target
+}
+
+// recoverConcurrency raises a throttled host's concurrency by one step once
+// its state has been stale for StateExpiry. Each step refreshes the state,
+// so successive steps are spaced one StateExpiry window apart.
+func (t *Transport) recoverConcurrency(host string, hs *hostState) {
+	if t.config.Recovery == nil {
+		return
+	}
+
+	target := t.recoveryTarget()
+
+	hs.mu.Lock()
+	current := hs.state.GetCurrentConcurrency()
+	if current >= target || hs.state.IsBlocked() || !hs.state.IsStale(t.config.StateExpiry) {
+		hs.mu.Unlock()
+		return
+	}
+
+	next := t.config.Recovery(current, target)
+	if next <= current {
+		next = current + 1
+	}
+	if next > target {
+		next = target
+	}
+
+	hs.state.SetCurrentConcurrency(next)
+	hs.state.SetClamped(false)
+	hs.state.Touch()
+	hs.semaphore.Resize(next)
+	hs.mu.Unlock()
+
+	if t.config.OnStateChange != nil {
+		t.config.OnStateChange(host, hs.state.Clone())
+	}
+}
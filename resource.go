@@ -0,0 +1,238 @@
+package capacitor
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// resourcePool tracks an independent rate-limit quota within a host key,
+// such as GitHub's core, search, and graphql resources reported in
+// X-RateLimit-Resource. Exhausting one resource blocks only requests
+// that map to it; the host's concurrency slots remain shared.
+type resourcePool struct {
+	mu           sync.Mutex
+	blockedUntil time.Time
+	remaining    int
+	limit        int
+	pacer        *pacer // nil unless Pacing is enabled
+}
+
+// ResourceStats represents statistics for a rate-limit resource within a host.
+type ResourceStats struct {
+	Remaining    int
+	Limit        int
+	BlockedUntil time.Time
+	PaceInterval time.Duration
+}
+
+// getBlockedUntil returns when the resource's block expires.
+func (p *resourcePool) getBlockedUntil() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.blockedUntil
+}
+
+// update records the quota and any block reported for the resource.
+func (p *resourcePool) update(action *SignalAction, jitter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if action.Block && action.BlockUntil.After(p.blockedUntil) {
+		p.blockedUntil = jitterBlock(action.BlockUntil, p.blockedUntil, jitter)
+	}
+	for _, signal := range action.Signals {
+		if signal.Limit > 0 {
+			p.limit = signal.Limit
+			p.remaining = signal.Remaining
+		}
+	}
+}
+
+func (p *resourcePool) stats() ResourceStats {
+	p.mu.Lock()
+	s := ResourceStats{
+		Remaining:    p.remaining,
+		Limit:        p.limit,
+		BlockedUntil: p.blockedUntil,
+	}
+	p.mu.Unlock()
+
+	if p.pacer != nil {
+		s.PaceInterval = p.pacer.currentInterval()
+	}
+	return s
+}
+
+// signalResource returns the rate-limit resource named by the signals, if any.
+func signalResource(signals []*Signal) string {
+	for _, signal := range signals {
+		if r := signal.Raw["Resource"]; r != "" {
+			return r
+		}
+	}
+	return ""
+}
+
+// routeKeys returns the path prefixes used to map requests to resources,
+// most specific first: the first two path segments, then the first one.
+// Two segments distinguish e.g. /search/code from /search/issues.
+func routeKeys(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	segments := strings.SplitN(path, "/", 3)
+	one := "/" + segments[0]
+	if len(segments) < 2 || segments[1] == "" {
+		return []string{one}
+	}
+	return []string{one + "/" + segments[1], one}
+}
+
+// maxRoutes caps the path prefixes learned per host. A two-segment prefix
+// is only kept when it is charged to a different resource than its
+// one-segment prefix, so APIs need few; the cap guards against hosts
+// reporting resources on arbitrary paths.
+const maxRoutes = 256
+
+// learnRoute records that requests under path are charged to resource.
+// The broader one-segment prefix keeps the first resource seen for it and
+// is the default for paths under it; the two-segment prefix is only kept
+// while its latest resource differs from that default. Paths without a
+// route are not charged to any resource, since charging them to a guessed
+// one could block them on another resource's quota.
+func (hs *hostState) learnRoute(path, resource string) {
+	keys := routeKeys(path)
+
+	hs.resMu.Lock()
+	defer hs.resMu.Unlock()
+
+	for _, key := range keys[1:] {
+		if _, ok := hs.routes[key]; !ok {
+			hs.setRouteLocked(key, resource)
+		}
+	}
+	if len(keys) > 1 && hs.routeLocked(keys[1:]) == resource {
+		delete(hs.routes, keys[0])
+	} else {
+		hs.setRouteLocked(keys[0], resource)
+	}
+}
+
+// routeLocked returns the resource charged for the first of keys with a
+// route, or "" if none has one. The caller must hold hs.resMu.
+func (hs *hostState) routeLocked(keys []string) string {
+	for _, key := range keys {
+		if resource, ok := hs.routes[key]; ok {
+			return resource
+		}
+	}
+	return ""
+}
+
+// setRouteLocked records a route unless the host already has maxRoutes.
+// The caller must hold hs.resMu.
+func (hs *hostState) setRouteLocked(key, resource string) {
+	if hs.routes == nil {
+		hs.routes = make(map[string]string)
+	}
+	if _, ok := hs.routes[key]; !ok && len(hs.routes) >= maxRoutes {
+		return
+	}
+	hs.routes[key] = resource
+}
+
+// restoreRoutes records routes restored from a snapshot. Routes to
+// resources not in keep are skipped.
+func (hs *hostState) restoreRoutes(routes map[string]string, keep map[string]ResourceSnapshot) {
+	hs.resMu.Lock()
+	defer hs.resMu.Unlock()
+
+	for prefix, name := range routes {
+		if _, ok := keep[name]; ok {
+			hs.setRouteLocked(prefix, name)
+		}
+	}
+}
+
+// snapshotResources records the state of each resource of the host and
+// the routes to them in h.
+func (hs *hostState) snapshotResources(h *HostSnapshot) {
+	hs.resMu.RLock()
+	defer hs.resMu.RUnlock()
+
+	if len(hs.resources) == 0 {
+		return
+	}
+	resources := make(map[string]ResourceSnapshot, len(hs.resources))
+	for name, p := range hs.resources {
+		p.mu.Lock()
+		resources[name] = ResourceSnapshot{
+			Remaining:    p.remaining,
+			Limit:        p.limit,
+			BlockedUntil: p.blockedUntil,
+		}
+		p.mu.Unlock()
+	}
+	routes := make(map[string]string, len(hs.routes))
+	for prefix, name := range hs.routes {
+		routes[prefix] = name
+	}
+	h.Resources, h.Routes = resources, routes
+}
+
+// resourceFor returns the pool for the resource a request path has been
+// learned to map to, or nil if the path has no known resource.
+func (hs *hostState) resourceFor(path string) *resourcePool {
+	hs.resMu.RLock()
+	defer hs.resMu.RUnlock()
+
+	return hs.resources[hs.routeLocked(routeKeys(path))]
+}
+
+// resource returns the pool for a resource, creating it if needed.
+func (t *Transport) resource(hs *hostState, name string) *resourcePool {
+	hs.resMu.Lock()
+	defer hs.resMu.Unlock()
+
+	if p, ok := hs.resources[name]; ok {
+		return p
+	}
+	if hs.resources == nil {
+		hs.resources = make(map[string]*resourcePool)
+	}
+
+	p := &resourcePool{}
+	if t.config.Pacing {
+		p.pacer = newPacer(t.config.PacingBurst)
+	}
+	hs.resources[name] = p
+	return p
+}
+
+// resourcesBlocked returns true if any resource of the host is blocked.
+func (hs *hostState) resourcesBlocked(now time.Time) bool {
+	hs.resMu.RLock()
+	defer hs.resMu.RUnlock()
+
+	for _, p := range hs.resources {
+		if now.Before(p.getBlockedUntil()) {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceStats returns statistics for each resource of the host,
+// or nil if none have been seen.
+func (hs *hostState) resourceStats() map[string]ResourceStats {
+	hs.resMu.RLock()
+	defer hs.resMu.RUnlock()
+
+	if len(hs.resources) == 0 {
+		return nil
+	}
+	stats := make(map[string]ResourceStats, len(hs.resources))
+	for name, p := range hs.resources {
+		stats[name] = p.stats()
+	}
+	return stats
+}
@@ -0,0 +1,45 @@
+package capacitor
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLearnRoute_KeepsExceptionsOnly(t *testing.T) {
+	hs := &hostState{}
+	for i := 0; i < 1000; i++ {
+		hs.learnRoute(fmt.Sprintf("/repos/owner-%d/repo", i), "core")
+	}
+	hs.learnRoute("/search/issues", "search")
+	hs.learnRoute("/search/code", "code_search")
+
+	want := map[string]string{
+		"/repos":       "core",
+		"/search":      "search",
+		"/search/code": "code_search",
+	}
+	if len(hs.routes) != len(want) {
+		t.Errorf("expected routes %v, got %v", want, hs.routes)
+	}
+	for prefix, resource := range want {
+		if hs.routes[prefix] != resource {
+			t.Errorf("expected %s routed to %q, got %q", prefix, resource, hs.routes[prefix])
+		}
+	}
+
+	// The exception is dropped once the prefix is charged to the default
+	hs.learnRoute("/search/code", "search")
+	if _, ok := hs.routes["/search/code"]; ok {
+		t.Error("expected route matching its prefix's resource to be dropped")
+	}
+}
+
+func TestLearnRoute_Capped(t *testing.T) {
+	hs := &hostState{}
+	for i := 0; i < 2*maxRoutes; i++ {
+		hs.learnRoute(fmt.Sprintf("/path-%d", i), "core")
+	}
+	if n := len(hs.routes); n != maxRoutes {
+		t.Errorf("expected routes capped at %d, got %d", maxRoutes, n)
+	}
+}
@@ -0,0 +1,188 @@
+package capacitor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy configures automatic retries of failed requests.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Default: 3
+	MaxAttempts int
+
+	// MinDelay is the delay before the first retry when the server did not
+	// signal when to retry. It doubles on each further retry, with jitter.
+	// Default: 500ms
+	MinDelay time.Duration
+
+	// MaxDelay is the longest the client will wait before a retry. If the
+	// server asks to wait longer (e.g., a rate limit that resets in an
+	// hour), the last response is returned instead of waiting.
+	// Default: 30s
+	MaxDelay time.Duration
+
+	// RetryOn decides whether a response or transport error is retryable.
+	// If nil, transport errors and 420, 429, 502, 503 and 504 responses
+	// are retried.
+	RetryOn func(resp *http.Response, err error) bool
+}
+
+// RetryAttempt describes a retry about to be made, for OnRetry.
+type RetryAttempt struct {
+	// Attempt is the number of the upcoming attempt (2 for the first retry).
+	Attempt int
+
+	// Delay is how long the client will wait before the attempt.
+	Delay time.Duration
+
+	// StatusCode is the status of the failed attempt, or 0 on error.
+	StatusCode int
+
+	// Err is the transport error of the failed attempt, if any.
+	Err error
+}
+
+// withDefaults returns a copy of the policy with defaults applied.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.MinDelay <= 0 {
+		p.MinDelay = 500 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 30 * time.Second
+	}
+	if p.RetryOn == nil {
+		p.RetryOn = defaultRetryOn
+	}
+	return p
+}
+
+// defaultRetryOn retries transport errors and overload status codes.
+// Capacity errors and cancellations are never retried.
+func defaultRetryOn(resp *http.Response, err error) bool {
+	if err != nil {
+		return !IsCapacityError(err) &&
+			!errors.Is(err, context.Canceled) &&
+			!errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, 420,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isReplayable returns true if a request may safely be sent again:
+// its method is idempotent or it can rewind its body with GetBody, and
+// any body can be replayed.
+func isReplayable(req *http.Request) bool {
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if hasBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.GetBody != nil
+}
+
+// roundTripWithRetry sends the request, retrying retryable failures.
+// Each attempt goes through the full capacity path: it waits for any block,
+// re-acquires a slot from the host's semaphore, and updates host state.
+func (t *Transport) roundTripWithRetry(req *http.Request) (*http.Response, error) {
+	policy := t.config.Retry.withDefaults()
+	ctx := req.Context()
+	host := t.hostKey(req.URL)
+
+	attemptReq := req
+	for attempt := 1; ; attempt++ {
+		resp, err := t.roundTrip(attemptReq)
+
+		if attempt >= policy.MaxAttempts || !isReplayable(req) || !policy.RetryOn(resp, err) {
+			return resp, err
+		}
+
+		delay := t.retryDelay(req, resp, policy, attempt)
+		if delay > policy.MaxDelay {
+			return resp, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+
+		next := req.Clone(WithRetryAttempt(ctx, attempt+1))
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			next.Body = body
+		}
+
+		retry := &RetryAttempt{
+			Attempt: attempt + 1,
+			Delay:   delay,
+			Err:     err,
+		}
+		if resp != nil {
+			retry.StatusCode = resp.StatusCode
+			// Drain so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if t.config.OnRetry != nil {
+			t.config.OnRetry(host, retry)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		attemptReq = next
+	}
+}
+
+// retryDelay returns how long to wait before the next attempt: the longest
+// of the server's Retry-After, any block on the host or the request's
+// rate-limit resource, and exponential backoff from MinDelay.
+func (t *Transport) retryDelay(req *http.Request, resp *http.Response, policy RetryPolicy, attempt int) time.Duration {
+	delay := policy.MinDelay
+	if shift := attempt - 1; shift < 32 {
+		if d := policy.MinDelay << shift; d > 0 {
+			delay = d
+		}
+	}
+	delay = jitter(delay)
+
+	if resp != nil {
+		if v := resp.Header.Get("Retry-After"); v != "" {
+			if d := parseRetryAfter(v); d > delay {
+				delay = d
+			}
+		}
+	}
+
+	t.mu.RLock()
+	hs := t.hosts[t.hostKey(req.URL)]
+	t.mu.RUnlock()
+	if hs != nil {
+		if d := time.Until(blockedUntil(hs, hs.resourceFor(req.URL.Path))); d > delay {
+			delay = d
+		}
+	}
+
+	return delay
+}
@@ -1,93 +1,334 @@
 package capacitor
 
 import (
+	"container/list"
 	"context"
 	"sync"
+	"time"
 )
 
+// DefaultPriorityAging is how long a waiter waits before its effective
+// priority is raised by one level.
+const DefaultPriorityAging = 1 * time.Second
+
 // Semaphore is a weighted semaphore that can be resized dynamically.
-// It is safe for concurrent use by multiple goroutines.
+// Waiters are granted slots highest priority first (see WithPriority).
+// Within a priority, flows (see WithFlow) share slots fairly in proportion
+// to the weight they acquire, and each flow is served in arrival order.
+// A waiter at the head of the queue holds back those behind it until its
+// whole weight fits, so heavy requests are not starved by light ones.
+//
+// Slots are handed directly to the next waiter on release, so a released
+// slot cannot be taken by a goroutine that arrived later. It is safe for
+// concurrent use by multiple goroutines.
 type Semaphore struct {
 	mu      sync.Mutex
-	cond    *sync.Cond
 	max     int
 	current int
-	waiters int
+	seq     uint64
+	aging   time.Duration
+
+	// Waiters are kept in a FIFO per priority and flow. Within one, the
+	// oldest waiter always outranks the rest, so only the fronts need to
+	// be compared to find the next waiter to grant.
+	queues  map[queueKey]*list.List
+	waiting int
+
+	// Fair queuing across flows: each flow's finish tag is the virtual
+	// time by which it has been served, and vclock is the start tag of
+	// the most recent grant
+	flows  map[string]*flow
+	vclock int64
+
+	// pruneAt is the number of flows above which idle flows are pruned
+	pruneAt int
+}
+
+// flow is the fair queuing state of a flow with waiters.
+type flow struct {
+	waiting int
+	finish  int64
 }
 
+// queueKey identifies the FIFO a waiter is queued in.
+type queueKey struct {
+	priority Priority
+	flow     string
+}
+
+// waiter is a goroutine blocked in Acquire. Its ready channel is closed
+// once its slots have been granted.
+type waiter struct {
+	n        int
+	priority Priority
+	flow     string
+	since    time.Time
+	seq      uint64
+	ready    chan struct{}
+	elem     *list.Element
+}
+
+// minFlowPrune is the fewest flows kept before idle ones are pruned.
+const minFlowPrune = 64
+
 // NewSemaphore creates a new semaphore with the given capacity.
 func NewSemaphore(n int) *Semaphore {
-	s := &Semaphore{max: n}
-	s.cond = sync.NewCond(&s.mu)
-	return s
+	return &Semaphore{
+		max:     n,
+		aging:   DefaultPriorityAging,
+		queues:  make(map[queueKey]*list.List),
+		flows:   make(map[string]*flow),
+		pruneAt: minFlowPrune,
+	}
+}
+
+// SetAging sets how long a waiter waits before its effective priority is
+// raised by one level, so low-priority requests are not starved by a
+// steady stream of higher-priority ones. Zero disables aging.
+func (s *Semaphore) SetAging(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aging = d
 }
 
 // Acquire blocks until a slot is available or the context is cancelled.
+// The request's priority and flow are read from ctx (see WithPriority
+// and WithFlow).
 // Returns nil on success, or the context error if cancelled.
 func (s *Semaphore) Acquire(ctx context.Context) error {
+	return s.AcquireN(ctx, 1)
+}
+
+// AcquireN blocks until n slots are available or the context is cancelled.
+// A request for more slots than the semaphore's capacity (for example,
+// after Resize shrinks it) is granted once every other slot is released,
+// so it runs alone instead of waiting forever.
+// Returns nil on success, or the context error if cancelled.
+func (s *Semaphore) AcquireN(ctx context.Context, n int) error {
+	if n < 1 {
+		n = 1
+	}
+
 	s.mu.Lock()
 
-	// Fast path: slot available
-	if s.current < s.max {
-		s.current++
+	// Fast path: slots available and nobody queued ahead
+	if s.waiting == 0 && s.fits(n) {
+		s.current += n
 		s.mu.Unlock()
 		return nil
 	}
 
-	// Slow path: need to wait
-	s.waiters++
+	// Slow path: queue up and wait for the slots to be handed over
+	w := &waiter{
+		n:        n,
+		priority: PriorityFromContext(ctx),
+		flow:     FlowFromContext(ctx),
+		since:    time.Now(),
+		seq:      s.seq,
+		ready:    make(chan struct{}),
+	}
+	s.seq++
+	s.enqueue(w)
+
+	// The new waiter may outrank a head that is waiting for more slots
+	s.grant()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		// Granted just as the context was cancelled; give the slots back
+		s.current -= n
+	default:
+		s.remove(w)
+	}
+
+	// Either way the head of the queue may now fit
+	s.grant()
+	return ctx.Err()
+}
+
+// grant hands free slots to waiters in order until the next one does not
+// fit. Must be called with s.mu held.
+func (s *Semaphore) grant() {
+	now := time.Now()
+	for s.waiting > 0 {
+		w := s.head(now)
+		if !s.fits(w.n) {
+			return
+		}
+		s.current += w.n
+		s.serve(w)
+		s.remove(w)
+		close(w.ready)
+	}
+}
+
+// fits returns true if n more slots may be taken. Must be called with
+// s.mu held.
+func (s *Semaphore) fits(n int) bool {
+	return s.current+n <= s.max || (s.current == 0 && n > s.max)
+}
+
+// head returns the waiter that should be granted the next slot: the one
+// with the highest effective priority, then from the flow that has been
+// served least, oldest first. Must be called with s.mu held.
+func (s *Semaphore) head(now time.Time) *waiter {
+	var best *waiter
+	var bestPriority Priority
+	var bestStart int64
+	for _, q := range s.queues {
+		w := q.Front().Value.(*waiter)
+		p := s.effective(w, now)
+		start := s.start(w.flow)
+		switch {
+		case best == nil, p > bestPriority:
+		case p < bestPriority:
+			continue
+		case start > bestStart:
+			continue
+		case start == bestStart && w.seq > best.seq:
+			continue
+		}
+		best, bestPriority, bestStart = w, p, start
+	}
+	return best
+}
+
+// start returns the virtual time at which a flow's next request would
+// start service. Flows that have been idle start at the current clock
+// rather than banking credit. Must be called with s.mu held.
+func (s *Semaphore) start(name string) int64 {
+	if f := s.flows[name]; f != nil && f.finish > s.vclock {
+		return f.finish
+	}
+	return s.vclock
+}
+
+// serve charges a granted waiter's weight to its flow. Must be called with
+// s.mu held.
+func (s *Semaphore) serve(w *waiter) {
+	start := s.start(w.flow)
+	s.flows[w.flow].finish = start + int64(w.n)
+	s.vclock = start
+
+	if len(s.flows) > s.pruneAt {
+		s.prune()
+	}
+}
 
-	// Create a channel to signal when we should wake up
-	done := make(chan struct{})
-	go func() {
-		select {
-		case <-ctx.Done():
-			s.mu.Lock()
-			s.cond.Broadcast()
-			s.mu.Unlock()
-		case <-done:
+// prune forgets flows with no waiters whose service the clock has caught
+// up with, so flows that come and go while the queue stays busy are not
+// kept forever. If idle flows still make up most of the map, the clock has
+// stalled behind a stream of new flows, and they are forgotten anyway,
+// forgiving the little service each is ahead by. The threshold grows with
+// the flows that remain, so pruning costs amortized constant time per
+// grant. Must be called with s.mu held.
+func (s *Semaphore) prune() {
+	idle := 0
+	for name, f := range s.flows {
+		if f.waiting > 0 {
+			continue
 		}
-	}()
-
-	for s.current >= s.max {
-		// Check context before waiting
-		select {
-		case <-ctx.Done():
-			s.waiters--
-			s.mu.Unlock()
-			close(done)
-			return ctx.Err()
-		default:
+		if f.finish <= s.vclock {
+			delete(s.flows, name)
+		} else {
+			idle++
 		}
+	}
+	if idle*2 > len(s.flows) {
+		for name, f := range s.flows {
+			if f.waiting <= 0 {
+				delete(s.flows, name)
+			}
+		}
+	}
+	s.pruneAt = max(2*len(s.flows), minFlowPrune)
+}
 
-		s.cond.Wait()
+// enqueue adds a waiter to the queue. Must be called with s.mu held.
+func (s *Semaphore) enqueue(w *waiter) {
+	key := queueKey{priority: w.priority, flow: w.flow}
+	q := s.queues[key]
+	if q == nil {
+		q = list.New()
+		s.queues[key] = q
+	}
+	w.elem = q.PushBack(w)
+	s.waiting++
 
-		// Check context after waking
-		select {
-		case <-ctx.Done():
-			s.waiters--
-			s.mu.Unlock()
-			close(done)
-			return ctx.Err()
-		default:
+	f := s.flows[w.flow]
+	if f == nil {
+		f = &flow{}
+		s.flows[w.flow] = f
+	}
+	f.waiting++
+}
+
+// effective returns a waiter's priority raised by one level for each aging
+// interval it has waited.
+func (s *Semaphore) effective(w *waiter, now time.Time) Priority {
+	if s.aging <= 0 {
+		return w.priority
+	}
+	return w.priority + Priority(now.Sub(w.since)/s.aging)
+}
+
+// remove removes a waiter from the queue. A flow is forgotten once it has
+// no waiters and no unserved debt. Must be called with s.mu held.
+func (s *Semaphore) remove(w *waiter) {
+	key := queueKey{priority: w.priority, flow: w.flow}
+	if q := s.queues[key]; q != nil {
+		q.Remove(w.elem)
+		if q.Len() == 0 {
+			delete(s.queues, key)
 		}
 	}
+	s.waiting--
 
-	s.current++
-	s.waiters--
-	s.mu.Unlock()
-	close(done)
-	return nil
+	if f := s.flows[w.flow]; f != nil {
+		f.waiting--
+		if f.waiting <= 0 && f.finish <= s.vclock {
+			delete(s.flows, w.flow)
+		}
+	}
+
+	// With nobody waiting there is no one to be fair to, so past service
+	// is forgiven and every flow starts afresh
+	if s.waiting == 0 {
+		clear(s.flows)
+		s.pruneAt = minFlowPrune
+	}
 }
 
-// TryAcquire attempts to acquire a slot without blocking.
+// TryAcquire attempts to acquire a slot without blocking. It does not
+// take a slot ahead of waiting goroutines.
 // Returns true if successful, false otherwise.
 func (s *Semaphore) TryAcquire() bool {
+	return s.TryAcquireN(1)
+}
+
+// TryAcquireN attempts to acquire n slots without blocking. It does not
+// take slots ahead of waiting goroutines.
+// Returns true if successful, false otherwise.
+func (s *Semaphore) TryAcquireN(n int) bool {
+	if n < 1 {
+		n = 1
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.current < s.max {
-		s.current++
+	if s.waiting == 0 && s.fits(n) {
+		s.current += n
 		return true
 	}
 	return false
@@ -95,17 +336,30 @@ func (s *Semaphore) TryAcquire() bool {
 
 // Release releases a slot back to the semaphore.
 func (s *Semaphore) Release() {
+	s.ReleaseN(1)
+}
+
+// ReleaseN releases n slots back to the semaphore.
+func (s *Semaphore) ReleaseN(n int) {
+	if n < 1 {
+		n = 1
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.current > 0 {
-		s.current--
-		s.cond.Signal()
+		s.current -= n
+		if s.current < 0 {
+			s.current = 0
+		}
+		// Hand the slots to the next waiters in line
+		s.grant()
 	}
 }
 
 // Resize changes the maximum capacity of the semaphore.
-// If the new capacity is larger, waiting goroutines may be woken.
+// If the new capacity is larger, waiting goroutines may be granted slots.
 // If smaller, no active slots are forcibly released.
 func (s *Semaphore) Resize(n int) {
 	s.mu.Lock()
@@ -114,9 +368,9 @@ func (s *Semaphore) Resize(n int) {
 	oldMax := s.max
 	s.max = n
 
-	// If we increased capacity, wake up waiters
+	// If we increased capacity, hand the new slots to waiters
 	if n > oldMax {
-		s.cond.Broadcast()
+		s.grant()
 	}
 }
 
@@ -145,5 +399,33 @@ func (s *Semaphore) InUse() int {
 func (s *Semaphore) Waiting() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.waiters
+	return s.waiting
+}
+
+// WaitingByPriority returns the number of goroutines waiting for a slot
+// at each requested priority.
+func (s *Semaphore) WaitingByPriority() map[Priority]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[Priority]int)
+	for key, q := range s.queues {
+		counts[key.priority] += q.Len()
+	}
+	return counts
+}
+
+// WaitingByFlow returns the number of goroutines waiting for a slot for
+// each flow. Requests without a flow are counted under "".
+func (s *Semaphore) WaitingByFlow() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int, len(s.flows))
+	for name, f := range s.flows {
+		if f.waiting > 0 {
+			counts[name] = f.waiting
+		}
+	}
+	return counts
 }
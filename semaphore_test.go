@@ -0,0 +1,62 @@
+package capacitor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSemaphore_ForgetsIdleFlows(t *testing.T) {
+	s := NewSemaphore(1)
+	if err := s.Acquire(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Many short-lived tenants queue once each while the semaphore is busy
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := WithFlow(context.Background(), fmt.Sprintf("tenant-%d", i))
+			if err := s.Acquire(ctx); err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			s.Release()
+		}(i)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Waiting() < 1000 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Release()
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.flows); n != 0 {
+		t.Errorf("expected no flows left once all tenants are gone, got %d", n)
+	}
+}
+
+func TestSemaphore_PrunesFlowsWhileBusy(t *testing.T) {
+	s := NewSemaphore(1)
+	s.current = 1
+
+	// One tenant stays queued throughout while others come and go
+	s.enqueue(&waiter{n: 1, flow: "steady", ready: make(chan struct{})})
+	for i := 0; i < 1000; i++ {
+		w := &waiter{n: 1, flow: fmt.Sprintf("tenant-%d", i), ready: make(chan struct{})}
+		s.enqueue(w)
+		s.serve(w)
+		s.remove(w)
+	}
+
+	if n := len(s.flows); n > 2*minFlowPrune {
+		t.Errorf("expected idle flows to be pruned while busy, got %d", n)
+	}
+}
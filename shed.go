@@ -0,0 +1,98 @@
+package capacitor
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Errors wrapped by a CapacityError with Op "shed" when a request is
+// rejected instead of queued for a slot.
+var (
+	ErrQueueFull           = errors.New("queue full")
+	ErrQueueTimeout        = errors.New("queue wait exceeded")
+	ErrDeadlineUnreachable = errors.New("deadline cannot be met")
+)
+
+// latencySmoothing is the weight of each new sample in a host's moving
+// average latency.
+const latencySmoothing = 0.2
+
+// queue acquires cost slots on the host's semaphore. If no slots are free,
+// the request is shed rather than queued when the host's queue is full or
+// the wait would outlast ctx's deadline, and while queued it is shed once
+// it has waited MaxQueueWait.
+func (t *Transport) queue(ctx context.Context, host string, hs *hostState, cost int) error {
+	if hs.semaphore.TryAcquireN(cost) {
+		return nil
+	}
+
+	if limit := t.config.MaxQueueLength; limit > 0 && hs.semaphore.Waiting() >= limit {
+		return t.shed(host, hs, ErrQueueFull)
+	}
+
+	if t.config.ShedByDeadline {
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(t.estimateDuration(hs, cost)).After(deadline) {
+			return t.shed(host, hs, ErrDeadlineUnreachable)
+		}
+	}
+
+	wctx := ctx
+	if t.config.MaxQueueWait > 0 {
+		var cancel context.CancelFunc
+		wctx, cancel = context.WithTimeout(ctx, t.config.MaxQueueWait)
+		defer cancel()
+	}
+
+	if err := hs.semaphore.AcquireN(wctx, cost); err != nil {
+		if ctx.Err() == nil {
+			return t.shed(host, hs, ErrQueueTimeout)
+		}
+		return &CapacityError{
+			Op:    "acquire",
+			Host:  host,
+			Err:   err,
+			State: hs.state.Clone(),
+		}
+	}
+	return nil
+}
+
+// shed counts a shed request and returns its error.
+func (t *Transport) shed(host string, hs *hostState, err error) error {
+	hs.shed.Add(1)
+	return &CapacityError{
+		Op:    "shed",
+		Host:  host,
+		Err:   err,
+		State: hs.state.Clone(),
+	}
+}
+
+// estimateDuration estimates how long a request needing cost slots will
+// take to complete: its wait in the queue, assuming slots free up at the
+// host's average latency, plus its own average latency. It returns 0 until
+// a latency has been observed.
+func (t *Transport) estimateDuration(hs *hostState, cost int) time.Duration {
+	hs.mu.Lock()
+	latency := hs.latency
+	hs.mu.Unlock()
+
+	capacity := hs.semaphore.Capacity()
+	if latency <= 0 || capacity <= 0 {
+		return 0
+	}
+	ahead := hs.semaphore.Waiting() + cost
+	wait := latency * time.Duration(ahead) / time.Duration(capacity)
+	return wait + latency
+}
+
+// trackLatency folds a request's latency into the host's moving average.
+// Must be called with hs.mu held.
+func trackLatency(hs *hostState, latency time.Duration) {
+	if hs.latency == 0 {
+		hs.latency = latency
+		return
+	}
+	hs.latency += time.Duration(latencySmoothing * float64(latency-hs.latency))
+}
@@ -33,10 +33,44 @@ type Signal struct {
 	// Message provides additional context
 	Message string
 
+	// Policies contains the quota policies advertised in the IETF
+	// RateLimit-Policy header (structured mode only)
+	Policies []RateLimitPolicy
+
+	// Quotas contains the remaining quotas reported in the IETF
+	// RateLimit header (structured mode only)
+	Quotas []RateLimitQuota
+
 	// Raw contains the raw header values for debugging
 	Raw map[string]string
 }
 
+// RateLimitPolicy is a quota policy advertised in the IETF RateLimit-Policy header,
+// e.g. "default";q=100;w=60.
+type RateLimitPolicy struct {
+	Name      string        // policy name, empty for unnamed policies
+	Quota     int           // quota allocated per window (q)
+	Window    time.Duration // quota window (w)
+	QuotaUnit string        // unit of the quota (qu), "requests" if unspecified
+	Partition string        // partition key (pk), if any
+}
+
+// RateLimitQuota is the remaining quota for a policy, reported in the IETF
+// RateLimit header, e.g. "default";r=50;t=30.
+type RateLimitQuota struct {
+	Policy    string        // name of the policy this quota belongs to
+	Remaining int           // remaining quota units (r)
+	Reset     time.Duration // time until the quota resets (t)
+	Partition string        // partition key (pk), if any
+}
+
+// Quota units defined by the IETF RateLimit headers draft.
+const (
+	QuotaUnitRequests           = "requests"
+	QuotaUnitContentBytes       = "content-bytes"
+	QuotaUnitConcurrentRequests = "concurrent-requests"
+)
+
 // SignalType categorizes the type of signal received.
 type SignalType string
 
@@ -70,6 +104,17 @@ type SignalHandler interface {
 	Process(resp *http.Response) *Signal
 }
 
+// ErrorSignalHandler is a SignalHandler that can also extract signals from
+// transport errors returned by the underlying RoundTripper, such as HTTP/2
+// GOAWAY frames or connection resets.
+type ErrorSignalHandler interface {
+	SignalHandler
+
+	// ProcessError examines a transport error and returns any detected signal.
+	// Returns nil if the error does not indicate a capacity signal.
+	ProcessError(err error) *Signal
+}
+
 // SignalAction represents what action to take based on signals.
 type SignalAction struct {
 	// AdjustConcurrency indicates concurrency should be changed
@@ -162,10 +207,25 @@ func (h *HTTPStatusHandler) Process(resp *http.Response) *Signal {
 //   - RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset (IETF draft standard)
 //   - CF-RateLimit-* (Cloudflare)
 //
+// In Structured mode it also parses the structured-field RateLimit and
+// RateLimit-Policy headers of the current IETF draft, which may carry
+// several named policies per response:
+//
+//	RateLimit-Policy: "default";q=100;w=60, "burst";q=10;w=1
+//	RateLimit: "default";r=50;t=30
+//
+// The parsed policies and quotas are exposed as Signal.Policies and
+// Signal.Quotas, and the most constrained request quota drives
+// Remaining, Limit and the reset time.
+//
 // See:
 //   - https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
 //   - https://docs.github.com/en/rest/overview/resources-in-the-rest-api#rate-limiting
-type RateLimitHandler struct{}
+type RateLimitHandler struct {
+	// Structured enables parsing of the structured-field RateLimit and
+	// RateLimit-Policy headers.
+	Structured bool
+}
 
 func (h *RateLimitHandler) Name() string  { return "ratelimit" }
 func (h *RateLimitHandler) Priority() int { return 20 }
@@ -211,13 +271,20 @@ func (h *RateLimitHandler) Process(resp *http.Response) *Signal {
 		signal.Raw["Policy"] = v
 	}
 
+	exhausted := signal.Remaining <= 0 && signal.Limit > 0
+	if h.Structured {
+		if quota, ok := h.processStructured(resp, signal); ok {
+			exhausted = quota.Remaining <= 0
+		}
+	}
+
 	// If no rate limit headers found, return nil
 	if len(signal.Raw) == 0 {
 		return nil
 	}
 
 	// Determine signal type based on remaining quota
-	if signal.Remaining <= 0 && signal.Limit > 0 {
+	if exhausted {
 		signal.Type = SignalTypeBlock
 		signal.Message = "Rate limit exceeded"
 	} else if signal.Limit > 0 && signal.Remaining < signal.Limit/10 {
@@ -231,6 +298,51 @@ func (h *RateLimitHandler) Process(resp *http.Response) *Signal {
 	return signal
 }
 
+// processStructured parses the structured-field RateLimit-Policy and RateLimit
+// headers into the signal. If a request quota was reported, the most
+// constrained one sets Remaining, Limit and the reset time, and is returned.
+func (h *RateLimitHandler) processStructured(resp *http.Response, signal *Signal) (RateLimitQuota, bool) {
+	if v := strings.Join(resp.Header.Values("RateLimit-Policy"), ", "); v != "" {
+		signal.Raw["Policy"] = v
+		signal.Policies = parseRateLimitPolicies(v)
+	}
+	if v := strings.Join(resp.Header.Values("RateLimit"), ", "); v != "" {
+		signal.Raw["RateLimit"] = v
+		signal.Quotas = parseRateLimitQuotas(v)
+	}
+
+	policies := make(map[string]RateLimitPolicy, len(signal.Policies))
+	for _, p := range signal.Policies {
+		policies[p.Name] = p
+	}
+
+	var chosen RateLimitQuota
+	found := false
+	for _, q := range signal.Quotas {
+		// Only request quotas constrain how many requests we send
+		if p, ok := policies[q.Policy]; ok && p.QuotaUnit != QuotaUnitRequests {
+			continue
+		}
+		if !found || q.Remaining < chosen.Remaining ||
+			(q.Remaining == chosen.Remaining && q.Reset > chosen.Reset) {
+			chosen = q
+			found = true
+		}
+	}
+	if !found {
+		return chosen, false
+	}
+
+	signal.Remaining = chosen.Remaining
+	if p, ok := policies[chosen.Policy]; ok {
+		signal.Limit = p.Quota
+	}
+	signal.RetryAfter = chosen.Reset
+	signal.BlockUntil = time.Now().Add(chosen.Reset)
+
+	return chosen, true
+}
+
 // getFirstHeader returns the first non-empty header value from the list of keys.
 func (h *RateLimitHandler) getFirstHeader(resp *http.Response, keys ...string) string {
 	for _, key := range keys {
@@ -296,7 +408,8 @@ func (h *CapacityHandler) Process(resp *http.Response) *Signal {
 // ----------------------------------------------------------------------------
 
 // GOAWAYHandler tracks HTTP/2 GOAWAY frames and connection resets.
-// Note: GOAWAY is handled at the error level, not response level.
+// Note: GOAWAY is handled at the error level, not response level,
+// so GOAWAYHandler implements ErrorSignalHandler.
 type GOAWAYHandler struct{}
 
 func (h *GOAWAYHandler) Name() string  { return "goaway" }
@@ -397,6 +510,65 @@ func parseRateLimitValue(v string) int {
 	return n
 }
 
+// parseRateLimitPolicies parses a structured-field RateLimit-Policy header.
+// Unnamed integer items from earlier drafts (e.g., "100;w=60") are accepted
+// as policies with an empty name. Malformed headers yield no policies.
+func parseRateLimitPolicies(v string) []RateLimitPolicy {
+	items, err := parseSFList(v)
+	if err != nil {
+		return nil
+	}
+
+	policies := make([]RateLimitPolicy, 0, len(items))
+	for _, item := range items {
+		p := RateLimitPolicy{
+			Name:      sfName(item),
+			QuotaUnit: sfString(item.Params, "qu"),
+			Partition: sfString(item.Params, "pk"),
+		}
+		if q, ok := sfInt(item.Params, "q"); ok {
+			p.Quota = int(q)
+		} else if q, ok := item.Value.(int64); ok {
+			p.Quota = int(q)
+		}
+		if w, ok := sfInt(item.Params, "w"); ok {
+			p.Window = time.Duration(w) * time.Second
+		}
+		if p.QuotaUnit == "" {
+			p.QuotaUnit = QuotaUnitRequests
+		}
+		policies = append(policies, p)
+	}
+	return policies
+}
+
+// parseRateLimitQuotas parses a structured-field RateLimit header.
+// Malformed headers yield no quotas.
+func parseRateLimitQuotas(v string) []RateLimitQuota {
+	items, err := parseSFList(v)
+	if err != nil {
+		return nil
+	}
+
+	quotas := make([]RateLimitQuota, 0, len(items))
+	for _, item := range items {
+		r, ok := sfInt(item.Params, "r")
+		if !ok {
+			continue
+		}
+		q := RateLimitQuota{
+			Policy:    sfName(item),
+			Remaining: int(r),
+			Partition: sfString(item.Params, "pk"),
+		}
+		if t, ok := sfInt(item.Params, "t"); ok {
+			q.Reset = time.Duration(t) * time.Second
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas
+}
+
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -0,0 +1,114 @@
+package capacitor
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseSFList(t *testing.T) {
+	items, err := parseSFList(`"default";q=100;w=60, burst;q=10;w=1;qu="requests", 5;w=2, (a b);x, ?1;flag`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(items) != 4 {
+		t.Fatalf("len(items) = %d, want 4", len(items))
+	}
+
+	if items[0].Value != "default" {
+		t.Errorf("items[0] = %v, want %q", items[0].Value, "default")
+	}
+	if q, _ := sfInt(items[0].Params, "q"); q != 100 {
+		t.Errorf("items[0] q = %d, want 100", q)
+	}
+	if items[1].Value != sfToken("burst") {
+		t.Errorf("items[1] = %v, want token burst", items[1].Value)
+	}
+	if qu := sfString(items[1].Params, "qu"); qu != "requests" {
+		t.Errorf("items[1] qu = %q, want %q", qu, "requests")
+	}
+	if items[2].Value != int64(5) {
+		t.Errorf("items[2] = %v, want 5", items[2].Value)
+	}
+	if items[3].Value != true || items[3].Params["flag"] != true {
+		t.Errorf("items[3] = %v %v, want boolean with flag", items[3].Value, items[3].Params)
+	}
+}
+
+func TestParseSFList_Invalid(t *testing.T) {
+	for _, v := range []string{
+		`"unterminated`, `a,`, `a;Q=1`, `a b`, `?2`,
+		`( `, `(a `, `(1;a=2 `, `"default";r=0;t=30, ( `,
+	} {
+		if _, err := parseSFList(v); err == nil {
+			t.Errorf("parseSFList(%q) succeeded, want error", v)
+		}
+	}
+}
+
+func TestRateLimitHandler_Structured(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Add("RateLimit-Policy", `"hourly";q=1000;w=3600, "burst";q=10;w=1`)
+	resp.Header.Add("RateLimit-Policy", `"bytes";q=1000000;w=60;qu="content-bytes"`)
+	resp.Header.Set("RateLimit", `"hourly";r=900;t=1800, "burst";r=1;t=1, "bytes";r=0;t=30`)
+
+	h := &RateLimitHandler{Structured: true}
+	signal := h.Process(resp)
+	if signal == nil {
+		t.Fatal("expected signal")
+	}
+
+	if len(signal.Policies) != 3 {
+		t.Fatalf("len(Policies) = %d, want 3", len(signal.Policies))
+	}
+	want := RateLimitPolicy{Name: "hourly", Quota: 1000, Window: time.Hour, QuotaUnit: QuotaUnitRequests}
+	if signal.Policies[0] != want {
+		t.Errorf("Policies[0] = %+v, want %+v", signal.Policies[0], want)
+	}
+	if signal.Policies[2].QuotaUnit != QuotaUnitContentBytes {
+		t.Errorf("Policies[2].QuotaUnit = %q, want %q", signal.Policies[2].QuotaUnit, QuotaUnitContentBytes)
+	}
+
+	if len(signal.Quotas) != 3 {
+		t.Fatalf("len(Quotas) = %d, want 3", len(signal.Quotas))
+	}
+
+	// The exhausted byte quota does not limit requests; the burst quota
+	// is the most constrained request quota
+	if signal.Remaining != 1 || signal.Limit != 10 {
+		t.Errorf("Remaining/Limit = %d/%d, want 1/10", signal.Remaining, signal.Limit)
+	}
+	if signal.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %v, want 1s", signal.RetryAfter)
+	}
+	if signal.Type != SignalTypeCapacity {
+		t.Errorf("Type = %q, want %q", signal.Type, SignalTypeCapacity)
+	}
+}
+
+func TestRateLimitHandler_StructuredExhausted(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("RateLimit", `"default";r=0;t=30`)
+
+	h := &RateLimitHandler{Structured: true}
+	signal := h.Process(resp)
+	if signal == nil {
+		t.Fatal("expected signal")
+	}
+	if signal.Type != SignalTypeBlock {
+		t.Errorf("Type = %q, want %q", signal.Type, SignalTypeBlock)
+	}
+	if until := time.Until(signal.BlockUntil); until < 29*time.Second || until > 30*time.Second {
+		t.Errorf("BlockUntil in %v, want ~30s", until)
+	}
+}
+
+func TestRateLimitHandler_StructuredIgnoredByDefault(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("RateLimit", `"default";r=0;t=30`)
+
+	h := &RateLimitHandler{}
+	if signal := h.Process(resp); signal != nil {
+		t.Errorf("expected no signal without structured mode, got %+v", signal)
+	}
+}
@@ -0,0 +1,81 @@
+package capacitor
+
+import (
+	"math/rand"
+	"time"
+)
+
+// jitterBlock returns when a block ending at until should expire, delayed
+// by a random amount up to max so that clients blocked by the same signal
+// do not all resume at once. A current block already within the jitter
+// window of until is kept, so repeated signals for the same window do not
+// re-roll it.
+func jitterBlock(until, current time.Time, max time.Duration) time.Time {
+	if max <= 0 {
+		return until
+	}
+	if !current.Before(until) && current.Before(until.Add(max)) {
+		return current
+	}
+	return until.Add(time.Duration(rand.Int63n(int64(max)))) //nolint:gosec // jitter does not need crypto randomness
+}
+
+// startSlowStart drops a host that has just been blocked to MinConcurrency,
+// remembering its previous concurrency to ramp back to once the block ends.
+// Must be called with hs.mu held.
+func (t *Transport) startSlowStart(hs *hostState) {
+	if t.config.SlowStart <= 0 {
+		return
+	}
+
+	current := hs.state.GetCurrentConcurrency()
+	if hs.rampTo == 0 {
+		hs.rampTo = current
+	}
+	if current > t.config.MinConcurrency {
+		hs.state.SetCurrentConcurrency(t.config.MinConcurrency)
+		hs.semaphore.Resize(t.config.MinConcurrency)
+	}
+}
+
+// slowStart ramps a host's concurrency linearly from MinConcurrency back to
+// its value before the last block, over SlowStart from when the block
+// ended. It is called as requests start and finish, so the limit rises as
+// the host proves it can take more traffic.
+func (t *Transport) slowStart(host string, hs *hostState) {
+	if t.config.SlowStart <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	hs.mu.Lock()
+	end := hs.state.GetBlockedUntil()
+	if hs.rampTo == 0 || now.Before(end) {
+		hs.mu.Unlock()
+		return
+	}
+
+	min := t.config.MinConcurrency
+	target := hs.rampTo
+	if elapsed := now.Sub(end); elapsed < t.config.SlowStart && target > min {
+		target = min + int(float64(target-min)*float64(elapsed)/float64(t.config.SlowStart))
+	} else {
+		hs.rampTo = 0
+	}
+
+	current := hs.state.GetCurrentConcurrency()
+	if target <= current {
+		hs.mu.Unlock()
+		return
+	}
+
+	hs.state.SetCurrentConcurrency(target)
+	hs.state.Touch()
+	hs.semaphore.Resize(target)
+	hs.mu.Unlock()
+
+	if t.config.OnStateChange != nil {
+		t.config.OnStateChange(host, hs.state.Clone())
+	}
+}
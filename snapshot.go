@@ -0,0 +1,233 @@
+package capacitor
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultSnapshotInterval is how often host state is written to the
+// SnapshotFile.
+const DefaultSnapshotInterval = 1 * time.Minute
+
+// Snapshot is the persisted state of every pool, written by SaveSnapshot
+// and read by LoadSnapshot.
+type Snapshot struct {
+	Taken time.Time               `json:"taken"`
+	Hosts map[string]HostSnapshot `json:"hosts"`
+}
+
+// HostSnapshot is the persisted state of one pool.
+type HostSnapshot struct {
+	State *State `json:"state"`
+	Level int    `json:"level,omitempty"`
+
+	// Resources are the pool's rate-limit resources by name, and Routes
+	// the path prefixes learned to map to them
+	Resources map[string]ResourceSnapshot `json:"resources,omitempty"`
+	Routes    map[string]string           `json:"routes,omitempty"`
+
+	// QuotaReset is when the StateStore quota being drawn from resets
+	QuotaReset time.Time `json:"quota_reset"`
+}
+
+// ResourceSnapshot is the persisted state of one rate-limit resource.
+type ResourceSnapshot struct {
+	Remaining    int       `json:"remaining"`
+	Limit        int       `json:"limit"`
+	BlockedUntil time.Time `json:"blocked_until"`
+}
+
+// SaveSnapshot writes the state of every pool to w as JSON.
+func (t *Transport) SaveSnapshot(w io.Writer) error {
+	snapshot := Snapshot{
+		Taken: time.Now(),
+		Hosts: make(map[string]HostSnapshot),
+	}
+
+	t.mu.RLock()
+	for key, hs := range t.hosts {
+		h := HostSnapshot{State: hs.state.Clone(), Level: hs.level}
+		hs.snapshotResources(&h)
+		hs.mu.Lock()
+		h.QuotaReset = hs.quotaReset
+		hs.mu.Unlock()
+		snapshot.Hosts[key] = h
+	}
+	t.mu.RUnlock()
+
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// LoadSnapshot restores pool state written by SaveSnapshot. Pools updated
+// within StateExpiry get back their learned concurrency, server-reported
+// state and resource quotas; block windows and quotas that have not yet
+// reset are restored regardless of age. Everything else in the snapshot is
+// discarded.
+func (t *Transport) LoadSnapshot(r io.Reader) error {
+	var snapshot Snapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for key, h := range snapshot.Hosts {
+		if h.State == nil {
+			continue
+		}
+		fresh := now.Sub(h.State.LastUpdated) <= t.config.StateExpiry
+		blocked := h.State.BlockedUntil.After(now)
+		quota := h.QuotaReset.After(now)
+		resources := restorableResources(h.Resources, fresh, now)
+		if !fresh && !blocked && !quota && len(resources) == 0 {
+			continue
+		}
+
+		hs := t.getOrCreateHostState(key, h.Level)
+		t.restoreResources(hs, resources, fresh, now)
+		hs.restoreRoutes(h.Routes, resources)
+		hs.mu.Lock()
+		if fresh {
+			n := h.State.CurrentConcurrency
+			if n < t.config.MinConcurrency {
+				n = t.config.MinConcurrency
+			}
+			if n > t.config.MaxConcurrency {
+				n = t.config.MaxConcurrency
+			}
+			hs.state.restore(h.State)
+			hs.state.SetCurrentConcurrency(n)
+			hs.semaphore.Resize(n)
+			hs.published = n
+		}
+		if blocked {
+			hs.state.SetBlockedUntil(h.State.BlockedUntil)
+		}
+		if quota {
+			hs.quotaReset = h.QuotaReset
+		}
+		hs.mu.Unlock()
+		hs.releaseRef()
+	}
+	return nil
+}
+
+// restorableResources returns the resources of a snapshot worth restoring:
+// all of them if the pool is fresh, else only those still blocked.
+func restorableResources(resources map[string]ResourceSnapshot, fresh bool, now time.Time) map[string]ResourceSnapshot {
+	if fresh {
+		return resources
+	}
+	var blocked map[string]ResourceSnapshot
+	for name, r := range resources {
+		if r.BlockedUntil.After(now) {
+			if blocked == nil {
+				blocked = make(map[string]ResourceSnapshot)
+			}
+			blocked[name] = r
+		}
+	}
+	return blocked
+}
+
+// restoreResources restores a pool's resources. Quotas are only restored if
+// the pool is fresh, and blocks only if they have not yet passed.
+func (t *Transport) restoreResources(hs *hostState, resources map[string]ResourceSnapshot, fresh bool, now time.Time) {
+	for name, r := range resources {
+		p := t.resource(hs, name)
+		p.mu.Lock()
+		if fresh {
+			p.remaining = r.Remaining
+			p.limit = r.Limit
+		}
+		if r.BlockedUntil.After(now) {
+			p.blockedUntil = r.BlockedUntil
+		}
+		p.mu.Unlock()
+	}
+}
+
+// loadSnapshotFile restores state from the SnapshotFile, if it exists.
+func (t *Transport) loadSnapshotFile() {
+	f, err := os.Open(t.config.SnapshotFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		t.snapshotError(err)
+		return
+	}
+	defer f.Close()
+
+	if err := t.LoadSnapshot(f); err != nil {
+		t.snapshotError(err)
+	}
+}
+
+// saveSnapshotFile writes a snapshot to the SnapshotFile. The snapshot is
+// written to a temporary file first and renamed into place, so a crash
+// mid-write never leaves a truncated snapshot.
+func (t *Transport) saveSnapshotFile() error {
+	path := t.config.SnapshotFile
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := t.SaveSnapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// snapshotLoop writes the SnapshotFile every SnapshotInterval until Close.
+func (t *Transport) snapshotLoop() {
+	defer close(t.snapshotDone)
+
+	ticker := time.NewTicker(t.config.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.snapshotStop:
+			return
+		case <-ticker.C:
+			if err := t.saveSnapshotFile(); err != nil {
+				t.snapshotError(err)
+			}
+		}
+	}
+}
+
+// Close stops periodic snapshots and writes a final snapshot to the
+// SnapshotFile, if one is configured. It does not interrupt requests in
+// flight. Close is safe to call more than once.
+func (t *Transport) Close() error {
+	if t.config.SnapshotFile == "" {
+		return nil
+	}
+
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.snapshotStop)
+		<-t.snapshotDone
+		err = t.saveSnapshotFile()
+	})
+	return err
+}
+
+// snapshotError reports a failure to read or write the SnapshotFile.
+func (t *Transport) snapshotError(err error) {
+	if t.config.OnSnapshotError != nil {
+		t.config.OnSnapshotError(err)
+	}
+}
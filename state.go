@@ -49,6 +49,10 @@ type State struct {
 	CurrentConcurrency int
 	BlockedUntil       time.Time
 
+	// Breaker is the state of the host's circuit breaker.
+	// It is always BreakerClosed if no CircuitBreaker is configured.
+	Breaker BreakerState
+
 	// Clamped indicates if CurrentConcurrency was adjusted from the
 	// SuggestedConcurrency due to MinConcurrency or MaxConcurrency constraints.
 	// This helps users detect when the backend suggests a concurrency outside
@@ -62,6 +66,7 @@ func NewState(initialConcurrency int) *State {
 		Status:             StatusUnknown,
 		CurrentConcurrency: initialConcurrency,
 		LastUpdated:        time.Now(),
+		Breaker:            BreakerClosed,
 	}
 }
 
@@ -181,6 +186,34 @@ func (s *State) GetBlockedUntil() time.Time {
 	return s.BlockedUntil
 }
 
+// GetLastUpdated returns when the state was last updated.
+func (s *State) GetLastUpdated() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.LastUpdated
+}
+
+// Touch marks the state as updated now.
+func (s *State) Touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastUpdated = time.Now()
+}
+
+// SetBreaker sets the circuit breaker state.
+func (s *State) SetBreaker(b BreakerState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Breaker = b
+}
+
+// GetBreaker returns the circuit breaker state.
+func (s *State) GetBreaker() BreakerState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Breaker
+}
+
 // IsStale returns true if the state hasn't been updated recently.
 func (s *State) IsStale(expiry time.Duration) bool {
 	s.mu.RLock()
@@ -188,6 +221,28 @@ func (s *State) IsStale(expiry time.Duration) bool {
 	return time.Since(s.LastUpdated) > expiry
 }
 
+// restore copies the server-reported state and LastUpdated from a
+// snapshot. Client-side limits and blocks are restored separately.
+func (s *State) restore(src *State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Status = src.Status
+	s.TasksRunning = src.TasksRunning
+	s.TasksDesired = src.TasksDesired
+	s.TasksPending = src.TasksPending
+	s.ClusterMaxConcurrency = src.ClusterMaxConcurrency
+	s.SuggestedConcurrency = src.SuggestedConcurrency
+	s.StateAge = src.StateAge
+	s.WorkerActive = src.WorkerActive
+	s.WorkerAvailable = src.WorkerAvailable
+	s.WorkerLoadFactor = src.WorkerLoadFactor
+	s.LatencyP99 = src.LatencyP99
+	s.LatencyHealth = src.LatencyHealth
+	s.LastUpdated = src.LastUpdated
+	s.Clamped = src.Clamped
+}
+
 // Clone returns a copy of the current state.
 func (s *State) Clone() *State {
 	s.mu.RLock()
@@ -210,5 +265,6 @@ func (s *State) Clone() *State {
 		CurrentConcurrency:    s.CurrentConcurrency,
 		BlockedUntil:          s.BlockedUntil,
 		Clamped:               s.Clamped,
+		Breaker:               s.Breaker,
 	}
 }
@@ -0,0 +1,300 @@
+package capacitor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultStateSyncInterval is how often a pool's state is refreshed from
+// the StateStore.
+const DefaultStateSyncInterval = 1 * time.Second
+
+// ErrNoQuota is returned by StateStore.TakeQuota when no unexpired quota is
+// stored for the key.
+var ErrNoQuota = errors.New("no shared quota")
+
+// SharedState is the part of a pool's state shared with other clients
+// through a StateStore.
+type SharedState struct {
+	// Concurrency is the most recently learned concurrency limit, or 0 if
+	// none is known.
+	Concurrency int
+
+	// BlockedUntil is when requests may be sent again after a block.
+	BlockedUntil time.Time
+
+	// Remaining is the rate-limit quota left until Reset. It is only
+	// meaningful while Reset is non-zero.
+	Remaining int
+	Reset     time.Time
+
+	// UpdatedAt is when the state was last saved.
+	UpdatedAt time.Time
+}
+
+// hasQuota returns true if the state carries a quota that has not reset.
+func (s *SharedState) hasQuota(now time.Time) bool {
+	return !s.Reset.IsZero() && s.Reset.After(now)
+}
+
+// merge applies an update to the state. Blocks only ever extend, and a
+// concurrency or quota is only replaced by one that is set.
+func (s *SharedState) merge(update *SharedState) {
+	if update.Concurrency > 0 {
+		s.Concurrency = update.Concurrency
+	}
+	if update.BlockedUntil.After(s.BlockedUntil) {
+		s.BlockedUntil = update.BlockedUntil
+	}
+	if !update.Reset.IsZero() {
+		s.Remaining = update.Remaining
+		s.Reset = update.Reset
+	}
+	if update.UpdatedAt.After(s.UpdatedAt) {
+		s.UpdatedAt = update.UpdatedAt
+	}
+}
+
+// StateStore shares learned pool state between clients, such as replicas
+// of a service calling the same API, so they converge on one set of limits
+// and one rate-limit budget. Keys are pool keys (see KeyFunc and KeysFunc).
+//
+// Store calls run synchronously on the request path: Load at most once per
+// StateSyncInterval per pool, TakeQuota on every request while a shared
+// quota window is open, and Save after every response that changed a
+// pool's limit, block or quota. Implementations should be fast, and must
+// be safe for concurrent use.
+type StateStore interface {
+	// Load returns the shared state for key, or nil if none is stored.
+	Load(ctx context.Context, key string) (*SharedState, error)
+
+	// Save merges update into the shared state for key (see SharedState
+	// for how fields are merged).
+	Save(ctx context.Context, key string, update *SharedState) error
+
+	// TakeQuota consumes n units of key's remaining quota and returns how
+	// many remain. A negative result means the quota was already spent.
+	// If no unexpired quota is stored, nothing is consumed and ErrNoQuota
+	// is returned.
+	TakeQuota(ctx context.Context, key string, n int) (int, error)
+}
+
+// MemoryStore is a StateStore held in memory. It shares state between
+// clients in the same process.
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]*SharedState
+}
+
+// NewMemoryStore creates an empty in-memory StateStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[string]*SharedState)}
+}
+
+// Load implements StateStore.
+func (m *MemoryStore) Load(ctx context.Context, key string) (*SharedState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.states[key]; ok {
+		clone := *s
+		return &clone, nil
+	}
+	return nil, nil
+}
+
+// Save implements StateStore.
+func (m *MemoryStore) Save(ctx context.Context, key string, update *SharedState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.states[key]
+	if !ok {
+		s = &SharedState{}
+		m.states[key] = s
+	}
+	s.merge(update)
+	return nil
+}
+
+// TakeQuota implements StateStore.
+func (m *MemoryStore) TakeQuota(ctx context.Context, key string, n int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.states[key]
+	if !ok || !s.hasQuota(time.Now()) {
+		return 0, ErrNoQuota
+	}
+	s.Remaining -= n
+	return s.Remaining, nil
+}
+
+// quotaFromSignals returns the lowest remaining rate-limit quota reported
+// by signals and when it resets.
+func quotaFromSignals(signals []*Signal) (remaining int, reset time.Time, ok bool) {
+	for _, signal := range signals {
+		_, raw := signal.Raw["Remaining"]
+		if (!raw && len(signal.Quotas) == 0) || signal.BlockUntil.IsZero() {
+			continue
+		}
+		if !ok || signal.Remaining < remaining {
+			remaining, reset, ok = signal.Remaining, signal.BlockUntil, true
+		}
+	}
+	return remaining, reset, ok
+}
+
+// syncLevels refreshes each of the request's pools from the StateStore and
+// takes cost units of any shared quota.
+func (t *Transport) syncLevels(ctx context.Context, keys []string, hs *hostState, parents []level, cost int) {
+	if t.config.StateStore == nil {
+		return
+	}
+	for _, l := range parents {
+		t.syncShared(ctx, l.key, l.hs, cost)
+	}
+	t.syncShared(ctx, keys[len(keys)-1], hs, cost)
+}
+
+// syncShared adopts a pool's shared state, at most once per
+// StateSyncInterval, and takes cost units of its shared quota. If the
+// quota is spent, the pool is blocked until it resets.
+func (t *Transport) syncShared(ctx context.Context, key string, hs *hostState, cost int) {
+	store := t.config.StateStore
+	now := time.Now()
+
+	hs.mu.Lock()
+	due := now.Sub(hs.lastSync) >= t.config.StateSyncInterval
+	if due {
+		hs.lastSync = now
+	}
+	hs.mu.Unlock()
+
+	if due {
+		shared, err := store.Load(ctx, key)
+		if err != nil {
+			t.storeError(key, err)
+		} else if shared != nil {
+			t.adoptShared(key, hs, shared, now)
+		}
+	}
+
+	hs.mu.Lock()
+	reset := hs.quotaReset
+	hs.mu.Unlock()
+	if !reset.After(now) {
+		return
+	}
+
+	remaining, err := store.TakeQuota(ctx, key, cost)
+	if errors.Is(err, ErrNoQuota) {
+		// The window expired or was evicted from the store; stop drawing
+		// from it until another quota is shared
+		hs.mu.Lock()
+		if hs.quotaReset.Equal(reset) {
+			hs.quotaReset = time.Time{}
+		}
+		hs.mu.Unlock()
+		return
+	}
+	if err != nil {
+		t.storeError(key, err)
+		return
+	}
+	if remaining < 0 {
+		t.applyAction(hs, &SignalAction{Block: true, BlockUntil: reset})
+	}
+}
+
+// adoptShared applies shared state to a pool: blocks are extended, a
+// concurrency saved since the pool last exchanged state with the store is
+// adopted, and an unexpired quota is drawn from on later requests.
+func (t *Transport) adoptShared(key string, hs *hostState, shared *SharedState, now time.Time) {
+	if shared.BlockedUntil.After(hs.state.GetBlockedUntil()) {
+		t.applyAction(hs, &SignalAction{Block: true, BlockUntil: shared.BlockedUntil})
+	}
+
+	hs.mu.Lock()
+	if shared.hasQuota(now) {
+		hs.quotaReset = shared.Reset
+	}
+
+	changed := false
+	if shared.Concurrency > 0 && shared.UpdatedAt.After(hs.sharedAt) {
+		n := shared.Concurrency
+		if n < t.config.MinConcurrency {
+			n = t.config.MinConcurrency
+		}
+		if n > t.config.MaxConcurrency {
+			n = t.config.MaxConcurrency
+		}
+		if n != hs.state.GetCurrentConcurrency() {
+			hs.state.SetCurrentConcurrency(n)
+			hs.semaphore.Resize(n)
+			hs.state.Touch()
+			changed = true
+		}
+		hs.published = n
+		hs.sharedAt = shared.UpdatedAt
+	}
+	hs.mu.Unlock()
+
+	if changed && t.config.OnStateChange != nil {
+		t.config.OnStateChange(key, hs.state.Clone())
+	}
+}
+
+// shareLevels saves what each of the request's pools learned from the
+// response to the StateStore.
+func (t *Transport) shareLevels(ctx context.Context, keys []string, hs *hostState, parents []level, actions []*SignalAction) {
+	if t.config.StateStore == nil {
+		return
+	}
+	for i, l := range parents {
+		t.share(ctx, l.key, l.hs, actions[i])
+	}
+	t.share(ctx, keys[len(keys)-1], hs, actions[len(parents)])
+}
+
+// share saves a pool's new concurrency, block or quota to the StateStore.
+// Nothing is saved if none of them changed.
+func (t *Transport) share(ctx context.Context, key string, hs *hostState, action *SignalAction) {
+	now := time.Now()
+	update := &SharedState{UpdatedAt: now}
+
+	hs.mu.Lock()
+	if current := hs.state.GetCurrentConcurrency(); current != hs.published {
+		update.Concurrency = current
+		hs.published = current
+		hs.sharedAt = now
+	}
+	if action != nil {
+		if action.Block {
+			update.BlockedUntil = action.BlockUntil
+		}
+		if remaining, reset, ok := quotaFromSignals(action.Signals); ok && reset.After(now) {
+			update.Remaining = remaining
+			update.Reset = reset
+			hs.quotaReset = reset
+		}
+	}
+	hs.mu.Unlock()
+
+	if update.Concurrency == 0 && update.BlockedUntil.IsZero() && update.Reset.IsZero() {
+		return
+	}
+	if err := t.config.StateStore.Save(ctx, key, update); err != nil {
+		t.storeError(key, err)
+	}
+}
+
+// storeError reports a StateStore failure. Requests proceed using local
+// state when the store is unavailable.
+func (t *Transport) storeError(key string, err error) {
+	if t.config.OnStoreError != nil {
+		t.config.OnStoreError(key, err)
+	}
+}
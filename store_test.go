@@ -0,0 +1,198 @@
+package capacitor_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/syntaqx/capacitor"
+)
+
+// fakeKV is an in-process KV for testing KVStore.
+type fakeKV struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	ttls map[string]time.Duration // 0 if the key never expires
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{data: make(map[string][]byte), ttls: make(map[string]time.Duration)}
+}
+
+func (f *fakeKV) Get(ctx context.Context, key string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data[key], nil
+}
+
+func (f *fakeKV) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data[key] = value
+	f.ttls[key] = ttl
+	return nil
+}
+
+func (f *fakeKV) DecrBy(ctx context.Context, key string, n int64) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, _ := strconv.ParseInt(string(f.data[key]), 10, 64)
+	v -= n
+	f.data[key] = []byte(strconv.FormatInt(v, 10))
+	return v, nil
+}
+
+func TestKVStore(t *testing.T) {
+	ctx := context.Background()
+	store := capacitor.NewKVStore(newFakeKV(), "test:")
+
+	if state, err := store.Load(ctx, "host"); err != nil || state != nil {
+		t.Fatalf("expected no state, got %+v, %v", state, err)
+	}
+
+	reset := time.Now().Add(time.Minute)
+	blocked := time.Now().Add(10 * time.Second)
+	store.Save(ctx, "host", &capacitor.SharedState{Concurrency: 5, Remaining: 3, Reset: reset})
+	store.Save(ctx, "host", &capacitor.SharedState{BlockedUntil: blocked})
+
+	for i, want := range []int{2, 1, 0, -1} {
+		if got, err := store.TakeQuota(ctx, "host", 1); err != nil || got != want {
+			t.Errorf("take %d: expected %d remaining, got %d, %v", i, want, got, err)
+		}
+	}
+
+	state, err := store.Load(ctx, "host")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state.Concurrency != 5 {
+		t.Errorf("expected concurrency 5 to survive a later save, got %d", state.Concurrency)
+	}
+	if !state.BlockedUntil.Equal(blocked) {
+		t.Errorf("expected block until %v, got %v", blocked, state.BlockedUntil)
+	}
+	if state.Remaining != -1 {
+		t.Errorf("expected remaining quota from the counter, got %d", state.Remaining)
+	}
+}
+
+func TestKVStore_TakeQuotaWithoutWindow(t *testing.T) {
+	ctx := context.Background()
+	kv := newFakeKV()
+	store := capacitor.NewKVStore(kv, "test:")
+
+	// A missing counter is not created
+	if _, err := store.TakeQuota(ctx, "host", 1); !errors.Is(err, capacitor.ErrNoQuota) {
+		t.Errorf("expected ErrNoQuota, got %v", err)
+	}
+	if _, ok := kv.data["test:host:quota"]; ok {
+		t.Error("expected no counter to be created for a missing quota")
+	}
+
+	// A counter left behind without a window is given a TTL
+	kv.data["test:host:quota"] = []byte("0")
+	if _, err := store.TakeQuota(ctx, "host", 1); !errors.Is(err, capacitor.ErrNoQuota) {
+		t.Errorf("expected ErrNoQuota, got %v", err)
+	}
+	if ttl := kv.ttls["test:host:quota"]; ttl <= 0 {
+		t.Errorf("expected stray counter to expire, got TTL %v", ttl)
+	}
+
+	// An expired window is not drawn from
+	memory := capacitor.NewMemoryStore()
+	memory.Save(ctx, "host", &capacitor.SharedState{Remaining: 5, Reset: time.Now().Add(-time.Second)})
+	if _, err := memory.TakeQuota(ctx, "host", 1); !errors.Is(err, capacitor.ErrNoQuota) {
+		t.Errorf("expected ErrNoQuota for an expired window, got %v", err)
+	}
+}
+
+func TestClient_SharedQuota(t *testing.T) {
+	stores := map[string]func() capacitor.StateStore{
+		"memory": func() capacitor.StateStore { return capacitor.NewMemoryStore() },
+		"kv":     func() capacitor.StateStore { return capacitor.NewKVStore(newFakeKV(), "test:") },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			// The server allows 3 requests per window across all clients
+			var requests int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt64(&requests, 1)
+				w.Header().Set("X-RateLimit-Limit", "3")
+				w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(3-n, 10))
+				w.Header().Set("X-RateLimit-Reset", "60")
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			store := newStore()
+			newClient := func() *capacitor.Client {
+				return capacitor.Wrap(nil).
+					WithRateLimitHeaders().
+					WithBlockMode(capacitor.BlockModeFailFast).
+					WithStateStore(store).
+					Build()
+			}
+			a, b := newClient(), newClient()
+
+			for i, c := range []*capacitor.Client{a, b, a} {
+				resp, err := c.Get(server.URL)
+				if err != nil {
+					t.Fatalf("request %d: unexpected error: %v", i, err)
+				}
+				resp.Body.Close()
+			}
+
+			// b never saw the quota run out, but the shared budget is spent
+			_, err := b.Get(server.URL)
+			if !capacitor.IsBlockedError(err) {
+				t.Fatalf("expected BlockedError from shared quota, got %v", err)
+			}
+			if n := atomic.LoadInt64(&requests); n != 3 {
+				t.Errorf("expected 3 requests to reach the server, got %d", n)
+			}
+		})
+	}
+}
+
+func TestClient_SharedConcurrency(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/throttle" {
+			w.Header().Set("X-Capacity-Suggested-Concurrency", "3")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	store := capacitor.NewMemoryStore()
+	newClient := func() *capacitor.Client {
+		return capacitor.Wrap(nil).
+			WithConcurrency(10, 1, 10).
+			WithCapacityHeaders().
+			WithStateStore(store).
+			Build()
+	}
+	a, b := newClient(), newClient()
+
+	resp, err := a.Get(server.URL + "/throttle")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = b.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if n := b.GetStats()[server.URL].CurrentConcurrency; n != 3 {
+		t.Errorf("expected b to adopt the shared limit of 3, got %d", n)
+	}
+}
@@ -0,0 +1,290 @@
+package capacitor
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Structured field parsing (RFC 8941), as used by the IETF RateLimit and
+// RateLimit-Policy headers. Only Lists are needed; inner lists are skipped.
+
+// sfItem is a structured field item with its parameters.
+type sfItem struct {
+	Value  interface{} // int64, float64, string, sfToken, []byte, or bool
+	Params map[string]interface{}
+}
+
+// sfToken is a structured field token, distinct from a string.
+type sfToken string
+
+var errSFSyntax = errors.New("structured field syntax error")
+
+// parseSFList parses a structured field List.
+func parseSFList(s string) ([]sfItem, error) {
+	p := &sfParser{s: s}
+	p.skipSP()
+
+	var items []sfItem
+	for !p.done() {
+		if p.peek() == '(' {
+			if err := p.skipInnerList(); err != nil {
+				return nil, err
+			}
+		} else {
+			item, err := p.parseItem()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+
+		p.skipOWS()
+		if p.done() {
+			break
+		}
+		if p.next() != ',' {
+			return nil, errSFSyntax
+		}
+		p.skipOWS()
+		if p.done() {
+			return nil, errSFSyntax // trailing comma
+		}
+	}
+	return items, nil
+}
+
+type sfParser struct {
+	s   string
+	pos int
+}
+
+func (p *sfParser) done() bool { return p.pos >= len(p.s) }
+func (p *sfParser) peek() byte { return p.s[p.pos] }
+
+func (p *sfParser) next() byte {
+	c := p.s[p.pos]
+	p.pos++
+	return c
+}
+
+func (p *sfParser) skipSP() {
+	for !p.done() && p.peek() == ' ' {
+		p.pos++
+	}
+}
+
+func (p *sfParser) skipOWS() {
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+func (p *sfParser) parseItem() (sfItem, error) {
+	v, err := p.parseBareItem()
+	if err != nil {
+		return sfItem{}, err
+	}
+	params, err := p.parseParams()
+	if err != nil {
+		return sfItem{}, err
+	}
+	return sfItem{Value: v, Params: params}, nil
+}
+
+func (p *sfParser) skipInnerList() error {
+	p.pos++ // '('
+	for !p.done() {
+		p.skipSP()
+		if p.done() {
+			break
+		}
+		if p.peek() == ')' {
+			p.pos++
+			_, err := p.parseParams()
+			return err
+		}
+		if _, err := p.parseItem(); err != nil {
+			return err
+		}
+	}
+	return errSFSyntax
+}
+
+func (p *sfParser) parseParams() (map[string]interface{}, error) {
+	params := make(map[string]interface{})
+	for !p.done() && p.peek() == ';' {
+		p.pos++
+		p.skipSP()
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{} = true
+		if !p.done() && p.peek() == '=' {
+			p.pos++
+			if v, err = p.parseBareItem(); err != nil {
+				return nil, err
+			}
+		}
+		params[key] = v
+	}
+	return params, nil
+}
+
+func (p *sfParser) parseKey() (string, error) {
+	if p.done() {
+		return "", errSFSyntax
+	}
+	if c := p.peek(); !(c >= 'a' && c <= 'z') && c != '*' {
+		return "", errSFSyntax
+	}
+	start := p.pos
+	for !p.done() {
+		c := p.peek()
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || strings.IndexByte("_-.*", c) >= 0 {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.s[start:p.pos], nil
+}
+
+func (p *sfParser) parseBareItem() (interface{}, error) {
+	if p.done() {
+		return nil, errSFSyntax
+	}
+	switch c := p.peek(); {
+	case c == '-' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case c == '"':
+		return p.parseString()
+	case c == ':':
+		return p.parseByteSeq()
+	case c == '?':
+		return p.parseBool()
+	case c == '*' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		return p.parseToken(), nil
+	default:
+		return nil, errSFSyntax
+	}
+}
+
+func (p *sfParser) parseNumber() (interface{}, error) {
+	start := p.pos
+	if p.peek() == '-' {
+		p.pos++
+	}
+	decimal := false
+	for !p.done() {
+		c := p.peek()
+		if c >= '0' && c <= '9' {
+			p.pos++
+		} else if c == '.' && !decimal {
+			decimal = true
+			p.pos++
+		} else {
+			break
+		}
+	}
+	num := p.s[start:p.pos]
+	if decimal {
+		return strconv.ParseFloat(num, 64)
+	}
+	return strconv.ParseInt(num, 10, 64)
+}
+
+func (p *sfParser) parseString() (interface{}, error) {
+	p.pos++ // opening quote
+	var b strings.Builder
+	for !p.done() {
+		c := p.next()
+		switch {
+		case c == '\\':
+			if p.done() {
+				return nil, errSFSyntax
+			}
+			next := p.next()
+			if next != '"' && next != '\\' {
+				return nil, errSFSyntax
+			}
+			b.WriteByte(next)
+		case c == '"':
+			return b.String(), nil
+		case c < 0x20 || c > 0x7e:
+			return nil, errSFSyntax
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return nil, errSFSyntax
+}
+
+func (p *sfParser) parseToken() sfToken {
+	start := p.pos
+	for !p.done() {
+		c := p.peek()
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),;<=>?@[\\]{}", c) >= 0 {
+			break
+		}
+		p.pos++
+	}
+	return sfToken(p.s[start:p.pos])
+}
+
+func (p *sfParser) parseByteSeq() (interface{}, error) {
+	p.pos++ // opening colon
+	end := strings.IndexByte(p.s[p.pos:], ':')
+	if end < 0 {
+		return nil, errSFSyntax
+	}
+	b64 := p.s[p.pos : p.pos+end]
+	p.pos += end + 1
+	return base64.StdEncoding.DecodeString(b64)
+}
+
+func (p *sfParser) parseBool() (interface{}, error) {
+	p.pos++ // '?'
+	if p.done() {
+		return nil, errSFSyntax
+	}
+	switch p.next() {
+	case '1':
+		return true, nil
+	case '0':
+		return false, nil
+	}
+	return nil, errSFSyntax
+}
+
+// sfInt returns an integer parameter, or false if absent or not an integer.
+func sfInt(params map[string]interface{}, key string) (int64, bool) {
+	v, ok := params[key].(int64)
+	return v, ok
+}
+
+// sfString returns a string or token parameter, or "" if absent.
+func sfString(params map[string]interface{}, key string) string {
+	switch v := params[key].(type) {
+	case string:
+		return v
+	case sfToken:
+		return string(v)
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// sfName returns an item's value as a name, for string or token items.
+func sfName(item sfItem) string {
+	switch v := item.Value.(type) {
+	case string:
+		return v
+	case sfToken:
+		return string(v)
+	}
+	return ""
+}
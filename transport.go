@@ -1,11 +1,15 @@
 package capacitor
 
 import (
+	"container/list"
 	"context"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Transport is an http.RoundTripper that enforces capacity limits
@@ -15,14 +19,68 @@ import (
 type Transport struct {
 	config *Config
 	base   http.RoundTripper
+	global *Semaphore // nil unless MaxTotalConcurrency is set
 
-	mu    sync.RWMutex
-	hosts map[string]*hostState
+	mu        sync.RWMutex
+	hosts     map[string]*hostState
+	lastSweep time.Time // last idle sweep, guarded by mu
+
+	// Hosts in recency order, most recently used first, guarded by lruMu.
+	// Nil unless MaxHosts or HostIdleTTL is set.
+	lruMu sync.Mutex
+	lru   *list.List
+
+	// Periodic snapshots, if SnapshotFile is set
+	snapshotStop chan struct{}
+	snapshotDone chan struct{}
+	closeOnce    sync.Once
 }
 
 type hostState struct {
-	state     *State
-	semaphore *Semaphore
+	// mu serializes concurrency adjustments that span state and semaphore
+	mu sync.Mutex
+
+	state      *State
+	semaphore  *Semaphore
+	controller ConcurrencyController
+	pacer      *pacer         // nil unless Pacing is enabled
+	budget     *retryBudget   // nil unless RetryBudget is set
+	breaker    *breaker       // nil unless CircuitBreaker is set
+	latencies  *latencyWindow // nil unless Hedging is set
+	hedges     atomic.Int64   // hedged attempts sent
+	shed       atomic.Int64   // requests shed instead of queued
+
+	// Rate-limit resources within the host, guarded by resMu
+	resMu     sync.RWMutex
+	resources map[string]*resourcePool
+	routes    map[string]string // path prefix -> resource
+
+	// Eviction tracking
+	key      string        // the host key the state is stored under
+	refs     atomic.Int64  // requests currently using this host
+	lastUsed atomic.Int64  // unix nanos of the last request
+	lruElem  *list.Element // position in Transport.lru, guarded by lruMu
+
+	// Backoff tracking, guarded by mu
+	backoffs    int       // consecutive backoff signals
+	healthy     int       // consecutive healthy responses
+	lastBackoff time.Time // when the last backoff signal was counted
+
+	// Moving average request latency, guarded by mu
+	latency time.Duration
+
+	// level is the index of the key in KeysFunc results, 0 being broadest
+	level int
+
+	// rampTo is the concurrency to slow start back to once a block ends,
+	// or 0 if not slow starting, guarded by mu
+	rampTo int
+
+	// StateStore sync, guarded by mu
+	lastSync   time.Time // when shared state was last loaded
+	quotaReset time.Time // when the shared quota being drawn from resets
+	published  int       // concurrency last saved to or loaded from the store
+	sharedAt   time.Time // when published was saved or loaded
 }
 
 // NewTransport creates a new capacity-aware transport.
@@ -34,20 +92,73 @@ func NewTransport(config *Config) *Transport {
 		base = http.DefaultTransport
 	}
 
-	return &Transport{
+	// Register the GOAWAY handler if enabled and not already present
+	if cfg.EnableGOAWAYHandling {
+		cfg.SignalHandlers = withGOAWAYHandler(cfg.SignalHandlers)
+	}
+
+	t := &Transport{
 		config: cfg,
 		base:   base,
 		hosts:  make(map[string]*hostState),
 	}
+	if cfg.MaxTotalConcurrency > 0 {
+		t.global = NewSemaphore(cfg.MaxTotalConcurrency)
+	}
+	if cfg.MaxHosts > 0 || cfg.HostIdleTTL > 0 {
+		t.lru = list.New()
+	}
+
+	// Pick up where the last process left off
+	if cfg.SnapshotFile != "" {
+		t.loadSnapshotFile()
+		t.snapshotStop = make(chan struct{})
+		t.snapshotDone = make(chan struct{})
+		go t.snapshotLoop()
+	}
+	return t
+}
+
+// withGOAWAYHandler returns handlers with a GOAWAYHandler added in priority
+// order, unless one is already registered. The input slice is not modified.
+func withGOAWAYHandler(handlers []SignalHandler) []SignalHandler {
+	for _, handler := range handlers {
+		if _, ok := handler.(*GOAWAYHandler); ok {
+			return handlers
+		}
+	}
+
+	result := make([]SignalHandler, 0, len(handlers)+1)
+	result = append(result, handlers...)
+	result = append(result, &GOAWAYHandler{})
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Priority() < result[j].Priority()
+	})
+	return result
 }
 
 // RoundTrip implements http.RoundTripper.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	host := t.hostKey(req.URL)
-	hs := t.getOrCreateHostState(host)
+	// Set the user agent once, on a copy, so the caller's request is not
+	// modified and retries cloned from it do not prefix it again
+	req = t.withUserAgent(req)
+
+	if t.config.Retry != nil {
+		return t.roundTripWithRetry(req)
+	}
+	return t.roundTrip(req)
+}
+
+// roundTrip sends a single attempt through the capacity path.
+func (t *Transport) roundTrip(req *http.Request) (*http.Response, error) {
+	keys := t.poolKeys(req.URL)
+	host := keys[len(keys)-1]
+	hs := t.getOrCreateHostState(host, len(keys)-1)
+	defer hs.releaseRef()
 
-	// Add user agent if configured
-	t.addUserAgent(req)
+	// Pools above the host key, broadest first
+	parents := t.parentLevels(keys)
+	defer releaseLevels(parents)
 
 	// Create a context with timeout for acquiring the semaphore
 	ctx := req.Context()
@@ -57,63 +168,310 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		defer cancel()
 	}
 
-	// Acquire a concurrency slot
-	if err := hs.semaphore.Acquire(ctx); err != nil {
+	// Expensive requests take several slots
+	cost := t.requestCost(req)
+
+	// Fail fast while the host's circuit breaker is open
+	probe, err := t.admit(host, hs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Adopt limits, blocks and quota shared by other clients
+	t.syncLevels(ctx, keys, hs, parents, cost)
+
+	// Ramp concurrency back up if the host has been quiet since throttling,
+	// or after a block has ended
+	t.recoverConcurrency(host, hs)
+	t.slowStart(host, hs)
+
+	// Requests charged to a known rate-limit resource honor its own quota
+	pool := hs.resourceFor(req.URL.Path)
+
+	// Wait for the next paced send time before taking a slot
+	if err := t.pace(ctx, host, hs, pool); err != nil {
+		hs.breaker.abandon(probe)
+		return nil, err
+	}
+
+	// Acquire slots in every pool, broadest first, once none is blocked,
+	// then the client-wide slot
+	if err := t.prepareLevels(ctx, parents); err != nil {
+		hs.breaker.abandon(probe)
+		return nil, err
+	}
+	if err := t.acquire(ctx, host, hs, pool, parents, cost); err != nil {
+		hs.breaker.abandon(probe)
+		return nil, err
+	}
+	if err := t.acquireGlobal(ctx, host, hs); err != nil {
+		hs.semaphore.ReleaseN(cost)
+		releaseLevelSlots(parents, cost)
+		hs.breaker.abandon(probe)
+		return nil, err
+	}
+
+	// Retries must fit within the host's retry budget. It is spent only
+	// once the retry holds its slots, so one rejected or shed on the way
+	// costs nothing.
+	retry := RetryAttemptFromContext(req.Context()) > 1
+	if hs.budget != nil && retry && !hs.budget.withdraw(time.Now()) {
+		hs.semaphore.ReleaseN(cost)
+		releaseLevelSlots(parents, cost)
+		t.releaseGlobal()
+		hs.breaker.abandon(probe)
 		return nil, &CapacityError{
-			Op:    "acquire",
+			Op:    "retry_budget",
 			Host:  host,
-			Err:   err,
+			Err:   ErrRetryBudgetExhausted,
 			State: hs.state.Clone(),
 		}
 	}
 
-	// Ensure we release the slot when done
-	defer hs.semaphore.Release()
-
 	// Make the actual request
-	resp, err := t.base.RoundTrip(req)
+	start := time.Now()
+	resp, err := t.send(req, hs, parents, cost)
+	outcome := Outcome{
+		Err:      err,
+		Latency:  time.Since(start),
+		Start:    start,
+		InFlight: hs.semaphore.InUse(),
+	}
+	release := func() {
+		hs.semaphore.ReleaseN(cost)
+		releaseLevelSlots(parents, cost)
+		t.releaseGlobal()
+		t.slowStart(host, hs)
+		t.slowStartLevels(parents)
+	}
 	if err != nil {
+		release()
+		actions := t.handleError(keys, hs, parents, err)
+		t.observeLevels(parents, actions, outcome)
+		outcome.Action = actions[len(parents)]
+		t.observe(host, hs, outcome)
+		t.recordBreaker(host, hs, outcome, probe)
+		t.shareLevels(req.Context(), keys, hs, parents, actions)
 		return nil, err
 	}
 
+	if hs.latencies != nil {
+		hs.latencies.add(outcome.Latency)
+	}
+
 	// Update state from response headers
-	t.updateState(host, hs, resp)
+	outcome.StatusCode = resp.StatusCode
+	actions := t.updateState(keys, hs, parents, req, resp)
+	t.observeLevels(parents, actions, outcome)
+	outcome.Action = actions[len(parents)]
+	t.observe(host, hs, outcome)
+	t.recordBreaker(host, hs, outcome, probe)
+	t.shareLevels(req.Context(), keys, hs, parents, actions)
+
+	// Only fresh traffic earns retry budget, so retries cannot fund retries
+	if hs.budget != nil && !retry && !outcome.Congested() && resp.StatusCode < 500 {
+		hs.budget.deposit(time.Now())
+	}
+
+	// Release the slot now, or hold it until the body is consumed
+	if t.config.ReleaseOnBodyClose && resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = newReleaseBody(req.Context(), resp.Body, release)
+	} else {
+		release()
+	}
 
 	return resp, nil
 }
 
-// getOrCreateHostState returns the state for a host, creating it if needed.
-func (t *Transport) getOrCreateHostState(host string) *hostState {
+// acquire waits for any block on the request's pools (parents, host and
+// rate-limit resource) to expire and then acquires cost concurrency slots
+// in each, broadest first. No slot is held while waiting out a block, so a
+// blocked pool does not starve siblings sharing its parents. If any pool
+// becomes blocked while waiting for the slots, all of them are released
+// and the blocks are honored before trying again.
+func (t *Transport) acquire(ctx context.Context, host string, hs *hostState, pool *resourcePool, parents []level, cost int) error {
+	for {
+		for _, l := range parents {
+			if err := t.waitUnblocked(ctx, l.key, l.hs, nil); err != nil {
+				return err
+			}
+		}
+		if err := t.waitUnblocked(ctx, host, hs, pool); err != nil {
+			return err
+		}
+
+		for i, l := range parents {
+			if err := t.queue(ctx, l.key, l.hs, cost); err != nil {
+				releaseLevelSlots(parents[:i], cost)
+				return err
+			}
+		}
+		if err := t.queue(ctx, host, hs, cost); err != nil {
+			releaseLevelSlots(parents, cost)
+			return err
+		}
+
+		if !levelsBlocked(hs, pool, parents, time.Now()) {
+			return nil
+		}
+		hs.semaphore.ReleaseN(cost)
+		releaseLevelSlots(parents, cost)
+	}
+}
+
+// requestCost returns the number of concurrency slots the request takes.
+func (t *Transport) requestCost(req *http.Request) int {
+	cost := CostFromContext(req.Context())
+	if cost == 0 && t.config.CostFunc != nil {
+		cost = t.config.CostFunc(req)
+	}
+	if cost < 1 {
+		cost = 1
+	}
+	return cost
+}
+
+// blockedUntil returns when requests to the host, charged to pool if
+// non-nil, may be sent again.
+func blockedUntil(hs *hostState, pool *resourcePool) time.Time {
+	until := hs.state.GetBlockedUntil()
+	if pool != nil {
+		if u := pool.getBlockedUntil(); u.After(until) {
+			until = u
+		}
+	}
+	return until
+}
+
+// waitUnblocked blocks until the host's BlockedUntil, and that of the
+// request's rate-limit resource, has passed. In BlockModeFailFast, or when
+// the block outlasts the context deadline, it returns a BlockedError
+// immediately instead of waiting.
+func (t *Transport) waitUnblocked(ctx context.Context, host string, hs *hostState, pool *resourcePool) error {
+	for {
+		until := blockedUntil(hs, pool)
+		wait := time.Until(until)
+		if wait <= 0 {
+			return nil
+		}
+
+		blocked := &CapacityError{
+			Op:    "blocked",
+			Host:  host,
+			Err:   &BlockedError{Until: until},
+			State: hs.state.Clone(),
+		}
+
+		if t.config.BlockMode == BlockModeFailFast {
+			return blocked
+		}
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(until) {
+			return blocked
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			blocked.Err = ctx.Err()
+			return blocked
+		case <-timer.C:
+			// Loop to re-check, the block may have been extended
+		}
+	}
+}
+
+// getOrCreateHostState returns the state for a host, creating it if needed
+// at the given KeysFunc level. The returned host is referenced until release
+// is called, which keeps it from being evicted while the request is in
+// progress.
+func (t *Transport) getOrCreateHostState(host string, level int) *hostState {
+	now := time.Now()
+
 	t.mu.RLock()
 	hs, ok := t.hosts[host]
+	if ok {
+		hs.acquireRef(now)
+	}
 	t.mu.RUnlock()
 
 	if ok {
+		t.touch(hs)
 		return hs
 	}
 
 	t.mu.Lock()
-	defer t.mu.Unlock()
 
 	// Double-check after acquiring write lock
 	if hs, ok := t.hosts[host]; ok {
+		hs.acquireRef(now)
+		t.mu.Unlock()
 		return hs
 	}
 
+	evicted := t.evictLocked(now)
+
 	hs = &hostState{
-		state:     NewState(t.config.InitialConcurrency),
-		semaphore: NewSemaphore(t.config.InitialConcurrency),
+		key:        host,
+		state:      NewState(t.config.InitialConcurrency),
+		semaphore:  NewSemaphore(t.config.InitialConcurrency),
+		controller: t.newController(),
+		level:      level,
+		published:  t.config.InitialConcurrency,
+	}
+	hs.semaphore.SetAging(t.config.PriorityAging)
+	if t.config.Pacing {
+		hs.pacer = newPacer(t.config.PacingBurst)
+	}
+	if t.config.RetryBudget != nil {
+		hs.budget = newRetryBudget(*t.config.RetryBudget)
+	}
+	if t.config.CircuitBreaker != nil {
+		hs.breaker = newBreaker(*t.config.CircuitBreaker)
 	}
+	if t.config.Hedging != nil {
+		hs.latencies = &latencyWindow{}
+	}
+	hs.acquireRef(now)
 	t.hosts[host] = hs
+	if t.lru != nil {
+		t.lruMu.Lock()
+		hs.lruElem = t.lru.PushFront(hs)
+		t.lruMu.Unlock()
+	}
+
+	t.mu.Unlock()
+
+	t.notifyEvicted(evicted)
 
 	return hs
 }
 
-// updateState updates the host state from response headers using signal handlers.
-func (t *Transport) updateState(host string, hs *hostState, resp *http.Response) {
+// acquireRef marks the host as used by an in-progress request.
+func (hs *hostState) acquireRef(now time.Time) {
+	hs.refs.Add(1)
+	hs.lastUsed.Store(now.UnixNano())
+}
+
+// releaseRef marks an in-progress request as finished with the host.
+func (hs *hostState) releaseRef() {
+	hs.refs.Add(-1)
+}
+
+// updateState updates pool state from response headers using signal
+// handlers. Each signal is routed to one of the request's pools (parents,
+// then hs) by SignalLevel. It returns the action taken for each pool, nil
+// where no signals applied.
+//
+// Signals naming a rate-limit resource (X-RateLimit-Resource) update that
+// resource's pool instead of the host, and the request path is learned as
+// belonging to the resource.
+func (t *Transport) updateState(keys []string, hs *hostState, parents []level, req *http.Request, resp *http.Response) []*SignalAction {
+	actions := make([]*SignalAction, len(keys))
+
 	// If no handlers configured, nothing to do
 	if len(t.config.SignalHandlers) == 0 {
-		return
+		return actions
 	}
 
 	// Process response through all registered signal handlers
@@ -121,54 +479,55 @@ func (t *Transport) updateState(host string, hs *hostState, resp *http.Response)
 	for _, handler := range t.config.SignalHandlers {
 		if signal := handler.Process(resp); signal != nil {
 			signals = append(signals, signal)
-
-			// Notify signal callback if configured
-			if t.config.OnSignal != nil {
-				t.config.OnSignal(host, signal)
-			}
 		}
 	}
 
 	// If no signals detected, keep current concurrency (defaults are sane)
 	if len(signals) == 0 {
-		return
-	}
-
-	// Process signals to determine action
-	action := t.processSignals(signals)
-
-	// Handle blocking signals (rate limit exceeded, etc.)
-	if action.Block {
-		hs.state.SetBlockedUntil(action.BlockUntil)
+		return actions
 	}
 
-	// Update concurrency if suggested
-	if action.AdjustConcurrency {
-		suggested := action.NewConcurrency
-		original := suggested
-		// Always enforce MinConcurrency as absolute floor, even if backend suggests 0
-		// This prevents complete blocking while respecting backend's signal to throttle
-		if suggested < t.config.MinConcurrency {
-			suggested = t.config.MinConcurrency
+	for i, routed := range t.routeSignals(keys, signals) {
+		if len(routed) == 0 {
+			continue
 		}
-		if suggested > t.config.MaxConcurrency {
-			suggested = t.config.MaxConcurrency
+		target := hs
+		if i < len(parents) {
+			target = parents[i].hs
 		}
+		t.notifySignals(keys[i], routed)
+		actions[i] = t.applySignals(target, req, resp, routed)
+	}
+	return actions
+}
 
-		current := hs.state.GetCurrentConcurrency()
-		if suggested != current {
-			hs.state.SetCurrentConcurrency(suggested)
-			hs.semaphore.Resize(suggested)
-
-			// Mark as clamped if we adjusted the suggestion
-			hs.state.SetClamped(original != suggested)
-
-			if t.config.OnStateChange != nil {
-				t.config.OnStateChange(host, hs.state.Clone())
+// applySignals updates a pool from the signals routed to it and returns
+// the action taken.
+func (t *Transport) applySignals(hs *hostState, req *http.Request, resp *http.Response, signals []*Signal) *SignalAction {
+	// Route resource-scoped signals to their own pool
+	hostSignals := signals
+	if resource := signalResource(signals); resource != "" {
+		hs.learnRoute(req.URL.Path, resource)
+		pool := t.resource(hs, resource)
+
+		var poolSignals []*Signal
+		hostSignals = nil
+		for _, signal := range signals {
+			if signal.Raw["Resource"] != "" {
+				poolSignals = append(poolSignals, signal)
+			} else {
+				hostSignals = append(hostSignals, signal)
 			}
 		}
+		pool.update(t.processSignals(poolSignals), t.config.BlockJitter)
+		updatePacer(pool.pacer, poolSignals)
 	}
 
+	// Process signals to determine action
+	action := t.processSignals(hostSignals)
+	t.applyAction(hs, action)
+	updatePacer(hs.pacer, hostSignals)
+
 	// Update state metadata from capacity headers if present
 	headers := make(map[string]string)
 	for _, key := range capacityHeaders {
@@ -179,6 +538,164 @@ func (t *Transport) updateState(host string, hs *hostState, resp *http.Response)
 	if len(headers) > 0 {
 		hs.state.Update(headers)
 	}
+
+	return action
+}
+
+// notifySignals calls OnSignal for each signal applied to a pool.
+func (t *Transport) notifySignals(key string, signals []*Signal) {
+	if t.config.OnSignal == nil {
+		return
+	}
+	for _, signal := range signals {
+		t.config.OnSignal(key, signal)
+	}
+}
+
+// handleError updates pool state from a transport error using the
+// registered ErrorSignalHandlers, routing each signal like updateState.
+// It returns the action taken for each pool, nil where no signals applied.
+func (t *Transport) handleError(keys []string, hs *hostState, parents []level, err error) []*SignalAction {
+	actions := make([]*SignalAction, len(keys))
+
+	var signals []*Signal
+	for _, handler := range t.config.SignalHandlers {
+		eh, ok := handler.(ErrorSignalHandler)
+		if !ok {
+			continue
+		}
+		if signal := eh.ProcessError(err); signal != nil {
+			signals = append(signals, signal)
+		}
+	}
+
+	if len(signals) == 0 {
+		return actions
+	}
+
+	for i, routed := range t.routeSignals(keys, signals) {
+		if len(routed) == 0 {
+			continue
+		}
+		target := hs
+		if i < len(parents) {
+			target = parents[i].hs
+		}
+		t.notifySignals(keys[i], routed)
+
+		action := t.processSignals(routed)
+
+		// Connection-level signals carry no headers, so any block window
+		// the handler computed is honored directly
+		for _, signal := range routed {
+			if signal.BlockUntil.After(action.BlockUntil) {
+				action.Block = true
+				action.BlockUntil = signal.BlockUntil
+			}
+			if signal.RetryAfter > action.RetryAfter {
+				action.RetryAfter = signal.RetryAfter
+			}
+		}
+
+		t.applyAction(target, action)
+		actions[i] = action
+	}
+	return actions
+}
+
+// applyAction applies the blocking part of a signal action to the host state,
+// jittering the block's expiry and starting a slow start if configured.
+// Other concurrency changes are decided by the host's ConcurrencyController.
+func (t *Transport) applyAction(hs *hostState, action *SignalAction) {
+	if action.Block {
+		hs.mu.Lock()
+		current := hs.state.GetBlockedUntil()
+		hs.state.SetBlockedUntil(jitterBlock(action.BlockUntil, current, t.config.BlockJitter))
+		if hs.state.IsBlocked() {
+			t.startSlowStart(hs)
+		}
+		hs.state.Touch()
+		hs.mu.Unlock()
+	}
+}
+
+// observe feeds a request outcome to the host's ConcurrencyController and
+// applies the resulting limit, clamped to the configured bounds.
+func (t *Transport) observe(host string, hs *hostState, outcome Outcome) {
+	hs.mu.Lock()
+	until := t.trackBackoff(hs, outcome)
+	hs.mu.Unlock()
+
+	// A backoff window is a block like any other: it is added to the
+	// action so it is jittered, slow started and shared the same way
+	if !until.IsZero() {
+		outcome.Action.Block = true
+		outcome.Action.BlockUntil = until
+		t.applyAction(hs, outcome.Action)
+	}
+
+	hs.mu.Lock()
+	trackLatency(hs, outcome.Latency)
+
+	current := hs.state.GetCurrentConcurrency()
+	suggested := hs.controller.Update(current, outcome)
+
+	// During a slow start the ramp decides increases. Responses to requests
+	// sent before the block are ignored; a decrease after it ends the ramp.
+	if hs.rampTo > 0 {
+		if suggested < current && !hs.state.IsBlocked() {
+			hs.rampTo = 0
+		} else {
+			suggested = current
+		}
+	}
+	original := suggested
+
+	// Always enforce MinConcurrency as absolute floor, even if backend suggests 0
+	// This prevents complete blocking while respecting backend's signal to throttle
+	if suggested < t.config.MinConcurrency {
+		suggested = t.config.MinConcurrency
+	}
+	if suggested > t.config.MaxConcurrency {
+		suggested = t.config.MaxConcurrency
+	}
+
+	if suggested == current {
+		hs.mu.Unlock()
+		return
+	}
+
+	hs.state.SetCurrentConcurrency(suggested)
+	hs.semaphore.Resize(suggested)
+
+	// Mark as clamped if we adjusted the suggestion
+	hs.state.SetClamped(original != suggested)
+	hs.state.Touch()
+	hs.mu.Unlock()
+
+	if t.config.OnStateChange != nil {
+		t.config.OnStateChange(host, hs.state.Clone())
+	}
+}
+
+// observeLevels feeds a request outcome to each parent pool's controller,
+// with the action taken for that pool.
+func (t *Transport) observeLevels(parents []level, actions []*SignalAction, outcome Outcome) {
+	for i, l := range parents {
+		outcome.Action = actions[i]
+		outcome.InFlight = l.hs.semaphore.InUse()
+		t.observe(l.key, l.hs, outcome)
+	}
+}
+
+// newController creates the ConcurrencyController for a new host key.
+func (t *Transport) newController() ConcurrencyController {
+	if t.config.Controller != nil {
+		if c := t.config.Controller(); c != nil {
+			return c
+		}
+	}
+	return &signalController{factor: t.config.BackoffFactor}
 }
 
 // processSignals aggregates signals into an action.
@@ -199,8 +716,11 @@ func (t *Transport) processSignals(signals []*Signal) *SignalAction {
 			}
 
 		case SignalTypeRateLimit, SignalTypeBackoff:
-			// Use the most conservative (lowest) suggested concurrency
-			if signal.SuggestedConcurrency >= 0 {
+			// Use the most conservative (lowest) suggested concurrency.
+			// Backoff signals without a suggestion reduce concurrency
+			// multiplicatively instead of dropping it to the minimum.
+			_, explicit := signal.Raw["X-Capacity-Suggested-Concurrency"]
+			if signal.Type == SignalTypeRateLimit || signal.SuggestedConcurrency > 0 || explicit {
 				if !action.AdjustConcurrency || signal.SuggestedConcurrency < action.NewConcurrency {
 					action.AdjustConcurrency = true
 					action.NewConcurrency = signal.SuggestedConcurrency
@@ -209,10 +729,21 @@ func (t *Transport) processSignals(signals []*Signal) *SignalAction {
 			if signal.Type == SignalTypeBackoff {
 				action.Backoff = true
 			}
+			// An explicit Retry-After asks us to stop sending until it passes
+			if _, ok := signal.Raw["Retry-After"]; ok && signal.BlockUntil.After(action.BlockUntil) {
+				action.Block = true
+				action.BlockUntil = signal.BlockUntil
+				if signal.RetryAfter > action.RetryAfter {
+					action.RetryAfter = signal.RetryAfter
+				}
+			}
 
 		case SignalTypeCapacity:
-			// Capacity signals suggest concurrency adjustments
-			if signal.SuggestedConcurrency >= 0 {
+			// Capacity signals suggest concurrency adjustments, but only when
+			// they carry a suggestion; informational signals (e.g., plenty of
+			// rate limit quota) must not reset concurrency to the minimum
+			_, explicit := signal.Raw["X-Capacity-Suggested-Concurrency"]
+			if signal.SuggestedConcurrency > 0 || explicit {
 				if !action.AdjustConcurrency {
 					action.AdjustConcurrency = true
 					action.NewConcurrency = signal.SuggestedConcurrency
@@ -224,26 +755,27 @@ func (t *Transport) processSignals(signals []*Signal) *SignalAction {
 	return action
 }
 
-// addUserAgent adds or appends the configured user agent.
-func (t *Transport) addUserAgent(req *http.Request) {
+// withUserAgent returns a copy of req with the configured user agent added
+// or prepended, or req itself if none is configured.
+func (t *Transport) withUserAgent(req *http.Request) *http.Request {
 	if t.config.UserAgent == "" {
-		return
+		return req
 	}
+	req = req.Clone(req.Context())
 	existing := req.Header.Get("User-Agent")
 	if existing == "" {
 		req.Header.Set("User-Agent", t.config.UserAgent)
 	} else {
 		req.Header.Set("User-Agent", t.config.UserAgent+" "+existing)
 	}
+	return req
 }
 
-// hostKey returns the key used for concurrency grouping.
-// If KeyFunc is configured, it is used; otherwise defaults to scheme://host.
+// hostKey returns the key used for concurrency grouping: the last of the
+// KeysFunc keys if configured, else KeyFunc, else scheme://host.
 func (t *Transport) hostKey(u *url.URL) string {
-	if t.config.KeyFunc != nil {
-		return t.config.KeyFunc(u)
-	}
-	return HostKeyFunc(u)
+	keys := t.poolKeys(u)
+	return keys[len(keys)-1]
 }
 
 // GetState returns the current state for a host, or nil if unknown.
@@ -264,14 +796,31 @@ func (t *Transport) GetStats() map[string]Stats {
 
 	stats := make(map[string]Stats, len(t.hosts))
 	for host, hs := range t.hosts {
-		stats[host] = Stats{
+		s := Stats{
 			CurrentConcurrency: hs.state.GetCurrentConcurrency(),
 			InUse:              hs.semaphore.InUse(),
 			Available:          hs.semaphore.Available(),
 			Waiting:            hs.semaphore.Waiting(),
+			WaitingByPriority:  hs.semaphore.WaitingByPriority(),
+			WaitingByFlow:      hs.semaphore.WaitingByFlow(),
 			Status:             hs.state.Status,
 			LastUpdated:        hs.state.LastUpdated,
+			Breaker:            hs.state.GetBreaker(),
+			Level:              hs.level,
+		}
+		if e, ok := hs.controller.(LimitEstimator); ok {
+			s.EstimatedLimit = e.EstimatedLimit()
+		}
+		if hs.pacer != nil {
+			s.PaceInterval = hs.pacer.currentInterval()
 		}
+		s.Resources = hs.resourceStats()
+		if hs.budget != nil {
+			s.Retries, s.RetryBudget = hs.budget.usage(time.Now())
+		}
+		s.Hedges = hs.hedges.Load()
+		s.Shed = hs.shed.Load()
+		stats[host] = s
 	}
 	return stats
 }
@@ -284,6 +833,44 @@ type Stats struct {
 	Waiting            int
 	Status             Status
 	LastUpdated        interface{}
+
+	// WaitingByPriority breaks Waiting down by request priority.
+	WaitingByPriority map[Priority]int
+
+	// WaitingByFlow breaks Waiting down by flow (see WithFlow).
+	// Requests without a flow are counted under "".
+	WaitingByFlow map[string]int
+
+	// EstimatedLimit is the controller's limit estimate, if the host's
+	// ConcurrencyController implements LimitEstimator.
+	EstimatedLimit float64
+
+	// PaceInterval is the time between requests when pacing a rate-limit
+	// quota, or 0 if the host is not being paced.
+	PaceInterval time.Duration
+
+	// Resources contains per-resource quota statistics for hosts that
+	// report X-RateLimit-Resource, keyed by resource name.
+	Resources map[string]ResourceStats
+
+	// Retries is the number of retries within the retry budget window,
+	// and RetryBudget the number allowed, if a RetryBudget is configured.
+	Retries     int
+	RetryBudget int
+
+	// Breaker is the state of the host's circuit breaker.
+	Breaker BreakerState
+
+	// Hedges is the number of hedged attempts sent to the host.
+	Hedges int64
+
+	// Shed is the number of requests rejected instead of queued.
+	Shed int64
+
+	// Level is the pool's position in the keys returned by KeysFunc,
+	// 0 being the broadest, when the pool was created. Pools without a
+	// KeysFunc are at level 0.
+	Level int
 }
 
 // capacityHeaders is the list of headers to look for in responses.